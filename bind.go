@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// bindControl returns a function binding sockets to the module's device, for
+// use as the Control function of a net.Dialer or net.ListenConfig.
+func bindControl(module Module) func(network, address string, c syscall.RawConn) error {
+	if module.BindToDevice == "" {
+		return nil
+	}
+	return func(_, _ string, c syscall.RawConn) error {
+		return bindToDevice(c, module.BindToDevice)
+	}
+}
+
+// sourceIP parses the module's source IP address, which is nil if unset.
+func sourceIP(module Module) (net.IP, error) {
+	if module.SourceIPAddress == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(module.SourceIPAddress)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source IP address %q", module.SourceIPAddress)
+	}
+	return ip, nil
+}
+
+// moduleDialer dials connections from the module's source IP address and
+// device, and to the address the module is pinned to, if any.
+type moduleDialer struct {
+	net.Dialer
+	// address replaces host in addresses dialed, so that a target can be
+	// probed at one of the addresses its name resolves to.
+	host    string
+	address string
+}
+
+// newModuleDialer returns a dialer for network, tcp or udp.
+func newModuleDialer(module Module, network string) (*moduleDialer, error) {
+	ip, err := sourceIP(module)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &moduleDialer{
+		Dialer:  net.Dialer{Timeout: module.Timeout, Control: bindControl(module)},
+		host:    module.host,
+		address: module.address,
+	}
+	if ip != nil {
+		switch network {
+		case "tcp":
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		case "udp":
+			dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		}
+	}
+	return dialer, nil
+}
+
+func (d *moduleDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.address != "" {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if host == d.host {
+			address = net.JoinHostPort(d.address, port)
+		}
+	}
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+func (d *moduleDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// resolveIPAddr resolves target to an IP address on network, ip4 or ip6,
+// unless the module is pinned to an address.
+func resolveIPAddr(module Module, network, target string) (*net.IPAddr, error) {
+	if module.address != "" {
+		target = module.address
+	}
+	return net.ResolveIPAddr(network, target)
+}
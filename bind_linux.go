@@ -0,0 +1,18 @@
+package main
+
+import (
+	"syscall"
+)
+
+// bindToDevice makes c only send and receive packets over the named network
+// interface.
+func bindToDevice(c syscall.RawConn, device string) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToDevice(c syscall.RawConn, device string) error {
+	return errors.New("binding to a device is only supported on Linux")
+}
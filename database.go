@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// timedDialer records how long establishing the connection took, and whether
+// it was established, so that it can be told apart from authenticating.
+type timedDialer struct {
+	dialer    *moduleDialer
+	duration  time.Duration
+	connected bool
+}
+
+func (d *timedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	d.duration = time.Since(start)
+	d.connected = err == nil
+	return conn, err
+}
+
+func (d *timedDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *timedDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+// newTimedDialer returns a timed dialer binding connections to the module's
+// source IP address and device.
+func newTimedDialer(module Module) (*timedDialer, error) {
+	dialer, err := newModuleDialer(module, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	return &timedDialer{dialer: dialer}, nil
+}
+
+type timedDialerKey struct{}
+
+// dialMySQL dials MySQL servers for the MySQL driver, which only supports
+// dialers registered globally, with the probe's dialer passed through the
+// context.
+func dialMySQL(ctx context.Context, addr string) (net.Conn, error) {
+	d, ok := ctx.Value(timedDialerKey{}).(*timedDialer)
+	if !ok {
+		return nil, errors.New("no dialer in the context of the MySQL connection")
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func init() {
+	mysql.RegisterDialContext("blackbox_tcp", dialMySQL)
+}
+
+// readPassword reads a password from a file, if configured, so that it needn't
+// be in the config.
+func readPassword(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	password, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// sqlFailureReason classifies an error connecting to a database after the
+// connection was established, which is not an error reported by the server.
+func sqlFailureReason(err error) failureReason {
+	if isTLSError(err) {
+		return failureTLS
+	}
+	return errorFailureReason(err, failureProtocol)
+}
+
+// postgreSQLFailureReason classifies an error connecting to PostgreSQL after
+// the connection was established.
+func postgreSQLFailureReason(err error) failureReason {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 28 is "invalid authorization specification", e.g. a wrong
+		// password or a user not allowed to connect.
+		if pqErr.Code.Class() == "28" {
+			return failureAuth
+		}
+		// The server rejected the connection for another reason, such as an
+		// unknown database.
+		return failureQuery
+	}
+	if errors.Is(err, pq.ErrSSLNotSupported) {
+		return failureTLS
+	}
+	return sqlFailureReason(err)
+}
+
+// mySQLFailureReason classifies an error connecting to MySQL after the
+// connection was established.
+func mySQLFailureReason(err error) failureReason {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		// ER_DBACCESS_DENIED_ERROR, ER_ACCESS_DENIED_ERROR and
+		// ER_ACCESS_DENIED_NO_PASSWORD_ERROR.
+		case 1044, 1045, 1698:
+			return failureAuth
+		}
+		return failureQuery
+	}
+	// The server asked for an authentication method the driver won't use.
+	if errors.Is(err, mysql.ErrCleartextPassword) || errors.Is(err, mysql.ErrNativePassword) || errors.Is(err, mysql.ErrOldPassword) || errors.Is(err, mysql.ErrUnknownPlugin) {
+		return failureAuth
+	}
+	if errors.Is(err, mysql.ErrNoTLS) {
+		return failureTLS
+	}
+	return sqlFailureReason(err)
+}
+
+// probeSQL connects to a database through connector, runs the configured
+// query and reports the server version, returned by versionQuery.  Errors
+// connecting after the connection was established are classified by
+// connectFailureReason.
+func probeSQL(ctx context.Context, logger *probeLogger, prefix string, connector driver.Connector, dialer *timedDialer, connectFailureReason func(error) failureReason, config DatabaseProbe, versionQuery string, metrics chan<- Metric) (bool, failureReason) {
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	openStart := time.Now()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		logger.Warn("Error connecting to database", "err", err)
+		if dialer.connected {
+			return false, connectFailureReason(err)
+		}
+		return false, errorFailureReason(err, failureConnect)
+	}
+	defer conn.Close()
+	openDuration := time.Since(openStart)
+	metrics <- Metric{prefix + "_connect_duration_seconds", dialer.duration.Seconds(), nil}
+	metrics <- Metric{prefix + "_auth_duration_seconds", (openDuration - dialer.duration).Seconds(), nil}
+
+	queryStart := time.Now()
+	rows, err := conn.QueryContext(ctx, config.Query)
+	if err != nil {
+		logger.Warn("Error running query", "query", config.Query, "err", err)
+		return false, errorFailureReason(err, failureQuery)
+	}
+	for rows.Next() {
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		logger.Warn("Error reading query result", "query", config.Query, "err", err)
+		return false, errorFailureReason(err, failureQuery)
+	}
+	metrics <- Metric{prefix + "_query_duration_seconds", time.Since(queryStart).Seconds(), nil}
+
+	var version string
+	if err := conn.QueryRowContext(ctx, versionQuery).Scan(&version); err != nil {
+		logger.Warn("Error querying server version", "err", err)
+		return false, errorFailureReason(err, failureQuery)
+	}
+	metrics <- Metric{prefix + "_info", 1, map[string]string{"version": version}}
+	return true, ""
+}
+
+func probePostgreSQL(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	config := module.PostgreSQL
+	if config.Query == "" {
+		config.Query = "SELECT 1"
+	}
+	password, err := readPassword(config.PasswordFile)
+	if err != nil {
+		module.logger.Error("Error reading password file", "err", err)
+		return false, failureConfig
+	}
+
+	dsn := url.URL{Scheme: "postgres", Host: target, Path: "/" + config.Database}
+	if config.Username != "" {
+		dsn.User = url.UserPassword(config.Username, password)
+	}
+	params := url.Values{}
+	switch {
+	case !config.TLS:
+		params.Set("sslmode", "disable")
+	case config.InsecureSkipVerify:
+		params.Set("sslmode", "require")
+	default:
+		params.Set("sslmode", "verify-full")
+	}
+	dsn.RawQuery = params.Encode()
+	connector, err := pq.NewConnector(dsn.String())
+	if err != nil {
+		module.logger.Error("Error in PostgreSQL module", "err", err)
+		return false, failureConfig
+	}
+	dialer, err := newTimedDialer(module)
+	if err != nil {
+		module.logger.Error("Error in PostgreSQL module", "err", err)
+		return false, failureConfig
+	}
+	connector.Dialer(dialer)
+	return probeSQL(ctx, module.logger, "probe_postgresql", connector, dialer, postgreSQLFailureReason, config, "SHOW server_version", metrics)
+}
+
+func probeMySQL(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	config := module.MySQL
+	if config.Query == "" {
+		config.Query = "SELECT 1"
+	}
+	password, err := readPassword(config.PasswordFile)
+	if err != nil {
+		module.logger.Error("Error reading password file", "err", err)
+		return false, failureConfig
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User, cfg.Passwd = config.Username, password
+	cfg.Net, cfg.Addr = "blackbox_tcp", target
+	cfg.DBName = config.Database
+	if config.TLS {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			module.logger.Error("Error splitting target", "err", err)
+			return false, failureConfig
+		}
+		cfg.TLS = &tls.Config{ServerName: host, InsecureSkipVerify: config.InsecureSkipVerify}
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		module.logger.Error("Error in MySQL module", "err", err)
+		return false, failureConfig
+	}
+	dialer, err := newTimedDialer(module)
+	if err != nil {
+		module.logger.Error("Error in MySQL module", "err", err)
+		return false, failureConfig
+	}
+	ctx = context.WithValue(ctx, timedDialerKey{}, dialer)
+	return probeSQL(ctx, module.logger, "probe_mysql", connector, dialer, mySQLFailureReason, config, "SELECT VERSION()", metrics)
+}
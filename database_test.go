@@ -0,0 +1,346 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+func TestReadPassword(t *testing.T) {
+	passwordFile, err := ioutil.TempFile("", "password")
+	if err != nil {
+		t.Fatalf("Error creating password file: %s", err)
+	}
+	defer os.Remove(passwordFile.Name())
+	passwordFile.WriteString("s3cret \r\n")
+	passwordFile.Close()
+
+	password, err := readPassword(passwordFile.Name())
+	if err != nil || password != "s3cret " {
+		t.Fatalf("Unexpected password: got %q, %v", password, err)
+	}
+	if password, err := readPassword(""); err != nil || password != "" {
+		t.Fatalf("Unexpected password without file: got %q, %v", password, err)
+	}
+}
+
+func TestSQLConnectionFails(t *testing.T) {
+	target := closedPort(t, "tcp")
+
+	module := Module{Timeout: time.Second}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, _ := probePostgreSQL(target, module, metrics); success {
+		t.Fatalf("PostgreSQL module succeeded, expected failure.")
+	}
+	if success, _ := probeMySQL(target, module, metrics); success {
+		t.Fatalf("MySQL module succeeded, expected failure.")
+	}
+}
+
+func TestSQLFailureReason(t *testing.T) {
+	for _, test := range []struct {
+		reason func(error) failureReason
+		err    error
+		want   failureReason
+	}{
+		{postgreSQLFailureReason, &pq.Error{Code: "28P01"}, failureAuth},
+		{postgreSQLFailureReason, &pq.Error{Code: "3D000"}, failureQuery},
+		{postgreSQLFailureReason, pq.ErrSSLNotSupported, failureTLS},
+		{postgreSQLFailureReason, x509.UnknownAuthorityError{}, failureTLS},
+		{postgreSQLFailureReason, io.ErrUnexpectedEOF, failureProtocol},
+		{mySQLFailureReason, &mysql.MySQLError{Number: 1045}, failureAuth},
+		{mySQLFailureReason, &mysql.MySQLError{Number: 1049}, failureQuery},
+		{mySQLFailureReason, mysql.ErrNoTLS, failureTLS},
+		{mySQLFailureReason, io.ErrUnexpectedEOF, failureProtocol},
+		{mySQLFailureReason, context.DeadlineExceeded, failureTimeout},
+	} {
+		if got := test.reason(test.err); got != test.want {
+			t.Errorf("Unexpected failure reason for %#v: got %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+// pgMessage encodes a PostgreSQL protocol message.  Strings are null
+// terminated, other fields are written in network byte order.
+func pgMessage(typ byte, fields ...interface{}) []byte {
+	var body bytes.Buffer
+	for _, f := range fields {
+		if s, ok := f.(string); ok {
+			body.WriteString(s)
+			body.WriteByte(0)
+		} else {
+			binary.Write(&body, binary.BigEndian, f)
+		}
+	}
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(body.Len()+4))
+	return append(msg, body.Bytes()...)
+}
+
+// readPGMessage reads a PostgreSQL protocol message, which but for the startup
+// message starts with its type.
+func readPGMessage(r *bufio.Reader, typed bool) (typ byte, body []byte, err error) {
+	if typed {
+		if typ, err = r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return 0, nil, err
+	}
+	body = make([]byte, size-4)
+	_, err = io.ReadFull(r, body)
+	return typ, body, err
+}
+
+// serveFakePostgreSQL serves simple queries on ln, accepting the cleartext
+// password secret.  Queries for missing_table fail, all others return a
+// single row.
+func serveFakePostgreSQL(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			if _, _, err := readPGMessage(r, false); err != nil {
+				return
+			}
+			conn.Write(pgMessage('R', int32(3)))
+			if typ, password, err := readPGMessage(r, true); err != nil || typ != 'p' {
+				return
+			} else if string(password) != "secret\x00" {
+				conn.Write(pgMessage('E', byte('S'), "FATAL", byte('C'), "28P01", byte('M'), "password authentication failed", byte(0)))
+				return
+			}
+			conn.Write(pgMessage('R', int32(0)))
+			conn.Write(pgMessage('Z', byte('I')))
+			for {
+				typ, query, err := readPGMessage(r, true)
+				if err != nil || typ != 'Q' {
+					return
+				}
+				value := "1"
+				switch string(query) {
+				case "SELECT * FROM missing_table\x00":
+					conn.Write(pgMessage('E', byte('S'), "ERROR", byte('C'), "42P01", byte('M'), "relation does not exist", byte(0)))
+					conn.Write(pgMessage('Z', byte('I')))
+					continue
+				case "SHOW server_version\x00":
+					value = "16.2"
+				}
+				// A single text column.
+				conn.Write(pgMessage('T', int16(1), "value", int32(0), int16(0), int32(25), int16(-1), int32(-1), int16(0)))
+				conn.Write(pgMessage('D', int16(1), int32(len(value)), []byte(value)))
+				conn.Write(pgMessage('C', "SELECT 1"))
+				conn.Write(pgMessage('Z', byte('I')))
+			}
+		}()
+	}
+}
+
+// writeMySQLPacket writes a MySQL protocol packet with the given sequence
+// number.
+func writeMySQLPacket(w io.Writer, seq byte, payload []byte) {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	w.Write(append(header, payload...))
+}
+
+// readMySQLPacket reads a MySQL protocol packet.
+func readMySQLPacket(r io.Reader) (seq byte, payload []byte, err error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	_, err = io.ReadFull(r, payload)
+	return header[3], payload, err
+}
+
+// mySQLNativePassword returns the response to the salt of the
+// mysql_native_password authentication method.
+func mySQLNativePassword(salt []byte, password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(salt)
+	h.Write(stage2[:])
+	response := h.Sum(nil)
+	for i := range response {
+		response[i] ^= stage1[i]
+	}
+	return response
+}
+
+// serveFakeMySQL serves text protocol queries on ln, accepting the password
+// secret.  Queries for missing_table fail, all others return a single row.
+func serveFakeMySQL(ln net.Listener) {
+	// CLIENT_LONG_PASSWORD, CLIENT_PROTOCOL_41, CLIENT_SECURE_CONNECTION and
+	// CLIENT_PLUGIN_AUTH.
+	const capabilities = 0x00000001 | 0x00000200 | 0x00008000 | 0x00080000
+	salt := []byte("0123456789abcdefghij")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var handshake bytes.Buffer
+			handshake.WriteByte(10)
+			handshake.WriteString("8.0.36\x00")
+			binary.Write(&handshake, binary.LittleEndian, uint32(1))
+			handshake.Write(salt[:8])
+			handshake.WriteByte(0)
+			binary.Write(&handshake, binary.LittleEndian, uint16(capabilities&0xffff))
+			handshake.WriteByte(33)
+			binary.Write(&handshake, binary.LittleEndian, uint16(2))
+			binary.Write(&handshake, binary.LittleEndian, uint16(capabilities>>16))
+			handshake.WriteByte(byte(len(salt) + 1))
+			handshake.Write(make([]byte, 10))
+			handshake.Write(salt[8:])
+			handshake.WriteString("\x00mysql_native_password\x00")
+			writeMySQLPacket(conn, 0, handshake.Bytes())
+
+			// The response starts with the capabilities, maximum packet size,
+			// character set and 23 bytes of filler, followed by the null
+			// terminated username and the length prefixed auth response.
+			seq, response, err := readMySQLPacket(conn)
+			if err != nil || len(response) < 32 {
+				return
+			}
+			user := response[32:]
+			end := bytes.IndexByte(user, 0)
+			if end < 0 || end+1 >= len(user) || end+2+int(user[end+1]) > len(user) {
+				return
+			}
+			if auth := user[end+2 : end+2+int(user[end+1])]; !bytes.Equal(auth, mySQLNativePassword(salt, "secret")) {
+				writeMySQLPacket(conn, seq+1, []byte("\xff\x15\x04#28000Access denied"))
+				return
+			}
+			writeMySQLPacket(conn, seq+1, []byte{0, 0, 0, 2, 0, 0, 0})
+
+			for {
+				_, command, err := readMySQLPacket(conn)
+				// Only COM_QUERY is supported.
+				if err != nil || len(command) == 0 || command[0] != 3 {
+					return
+				}
+				value := "1"
+				switch string(command[1:]) {
+				case "SELECT * FROM missing_table":
+					writeMySQLPacket(conn, 1, []byte("\xff\x7a\x04#42S02Table doesn't exist"))
+					continue
+				case "SELECT VERSION()":
+					value = "8.0.36"
+				}
+				// A single VARCHAR column, its definition and row each
+				// followed by an EOF packet.
+				eof := []byte{0xfe, 0, 0, 2, 0}
+				writeMySQLPacket(conn, 1, []byte{1})
+				writeMySQLPacket(conn, 2, []byte("\x03def\x00\x00\x00\x05value\x00\x0c\x21\x00\xff\x00\x00\x00\xfd\x00\x00\x00\x00\x00"))
+				writeMySQLPacket(conn, 3, eof)
+				writeMySQLPacket(conn, 4, append([]byte{byte(len(value))}, value...))
+				writeMySQLPacket(conn, 5, eof)
+			}
+		}()
+	}
+}
+
+func TestSQLQuery(t *testing.T) {
+	passwordFiles := map[string]string{}
+	for _, password := range []string{"secret", "wrong"} {
+		passwordFile, err := ioutil.TempFile("", "password")
+		if err != nil {
+			t.Fatalf("Error creating password file: %s", err)
+		}
+		defer os.Remove(passwordFile.Name())
+		passwordFile.WriteString(password + "\n")
+		passwordFile.Close()
+		passwordFiles[password] = passwordFile.Name()
+	}
+
+	for _, db := range []struct {
+		prefix  string
+		serve   func(net.Listener)
+		probe   func(string, Module, chan<- Metric) (bool, failureReason)
+		module  func(DatabaseProbe) Module
+		version string
+	}{
+		{"probe_postgresql", serveFakePostgreSQL, probePostgreSQL, func(config DatabaseProbe) Module { return Module{Timeout: time.Second, PostgreSQL: config} }, "16.2"},
+		{"probe_mysql", serveFakeMySQL, probeMySQL, func(config DatabaseProbe) Module { return Module{Timeout: time.Second, MySQL: config} }, "8.0.36"},
+	} {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Error listening on socket: %s", err)
+		}
+		defer ln.Close()
+		go db.serve(ln)
+
+		for _, test := range []struct {
+			config  DatabaseProbe
+			failure failureReason
+		}{
+			{DatabaseProbe{Username: "blackbox", PasswordFile: passwordFiles["secret"]}, ""},
+			{DatabaseProbe{Username: "blackbox", PasswordFile: passwordFiles["secret"], Query: "SELECT * FROM missing_table"}, failureQuery},
+			{DatabaseProbe{Username: "blackbox", PasswordFile: passwordFiles["wrong"]}, failureAuth},
+		} {
+			metrics := make(chan Metric, 100)
+			success, failure := db.probe(ln.Addr().String(), db.module(test.config), metrics)
+			if success != (test.failure == "") || failure != test.failure {
+				t.Fatalf("Unexpected result for %s with %+v: got %t with reason %q, want reason %q", db.prefix, test.config, success, failure, test.failure)
+			}
+			close(metrics)
+			values := map[string]Metric{}
+			for m := range metrics {
+				values[m.Name] = m
+			}
+			if !success {
+				continue
+			}
+			for _, name := range []string{"_connect_duration_seconds", "_auth_duration_seconds", "_query_duration_seconds"} {
+				if _, ok := values[db.prefix+name]; !ok {
+					t.Fatalf("Expected %s%s for %+v", db.prefix, name, test.config)
+				}
+			}
+			if version := values[db.prefix+"_info"].Labels["version"]; version != db.version {
+				t.Fatalf("Unexpected %s version: got %q, want %q", db.prefix, version, db.version)
+			}
+		}
+	}
+}
+
+func TestMySQLDialWithoutDialer(t *testing.T) {
+	if _, err := dialMySQL(context.Background(), "localhost:3306"); err == nil {
+		t.Fatalf("Dialing MySQL without a dialer in the context succeeded, expected an error.")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// failureReason classifies why a probe failed.  It is reported as the reason
+// label of probe_failure_info.
+type failureReason string
+
+const (
+	// The module, or a file it refers to, is invalid.
+	failureConfig failureReason = "config"
+	// The target could not be resolved.
+	failureDNS failureReason = "dns"
+	// The target could not be connected to, or did not reply at all.
+	failureConnect failureReason = "connect"
+	// The probe ran out of time.
+	failureTimeout failureReason = "timeout"
+	// The TLS handshake failed.
+	failureTLS failureReason = "tls"
+	// Reading from or writing to an established connection failed.
+	failureIO failureReason = "io"
+	// The target replied with something other than what the protocol calls
+	// for, such as an unexpected SMTP reply code or ICMP message.
+	failureProtocol failureReason = "protocol"
+	// An HTTP response had a status code which is not valid for the module.
+	failureStatusCode failureReason = "status_code"
+	// A response did not match what the module expects.
+	failureRegexp failureReason = "regexp"
+	// The target was not probed over SSL although fail_if_not_ssl is set.
+	failureSSLRequired failureReason = "ssl_required"
+	// The target was probed over SSL although fail_if_ssl is set.
+	failureSSLForbidden failureReason = "ssl_forbidden"
+	// The credentials of the module were rejected.
+	failureAuth failureReason = "auth"
+	// A database query failed, or the server refused the connection for a
+	// reason other than the credentials.
+	failureQuery failureReason = "query"
+	// A gRPC service is not serving.
+	failureNotServing failureReason = "not_serving"
+	// An SSH host key matches none of the expected fingerprints.
+	failureHostKey failureReason = "host_key"
+	// A router reported the target unreachable, or a traceroute did not reach
+	// it.
+	failureUnreachable failureReason = "unreachable"
+)
+
+// isTLSError reports whether err is caused by a failed TLS handshake or an
+// invalid certificate.
+func isTLSError(err error) bool {
+	var certErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	return errors.As(err, &certErr) || errors.As(err, &hostErr) || errors.As(err, &invalidErr) || errors.As(err, &recordErr)
+}
+
+// errorFailureReason classifies an error, returning reason unless it is a
+// failed DNS lookup or a timeout.
+func errorFailureReason(err error, reason failureReason) failureReason {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && !dnsErr.IsTimeout {
+		return failureDNS
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return failureTimeout
+	}
+	return reason
+}
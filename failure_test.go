@@ -0,0 +1,57 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorFailureReason(t *testing.T) {
+	for i, test := range []struct {
+		err    error
+		reason failureReason
+	}{
+		{errors.New("connection refused"), failureConnect},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, failureDNS},
+		{&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, failureTimeout},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid"}}, failureDNS},
+		{fmt.Errorf("calling: %w", context.DeadlineExceeded), failureTimeout},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, failureTimeout},
+	} {
+		if got := errorFailureReason(test.err, failureConnect); got != test.reason {
+			t.Errorf("Test %d: unexpected reason for %v: got %q, want %q", i, test.err, got, test.reason)
+		}
+	}
+}
+
+func TestProbeFailureInfo(t *testing.T) {
+	target := closedPort(t, "tcp")
+
+	config := &Config{Modules: map[string]Module{
+		"tcp_connect": {Prober: "tcp", Timeout: time.Second},
+	}}
+	w := httptest.NewRecorder()
+	probeHandler(w, httptest.NewRequest("GET", "/probe?module=tcp_connect&target="+target, nil), config, newProbeHistory(10))
+	if body := w.Body.String(); !strings.Contains(body, "probe_failure_info{reason=\"connect\"} 1.000000\n") {
+		t.Fatalf("Expected the connect failure reason in:\n%s", body)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func probeGRPC(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	config := module.GRPC
+
+	creds := insecure.NewCredentials()
+	if config.TLS {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			module.logger.Error("Error splitting target", "err", err)
+			return false, failureConfig
+		}
+		creds = credentials.NewTLS(&tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		})
+	}
+
+	dialer, err := newModuleDialer(module, "tcp")
+	if err != nil {
+		module.logger.Error("Error in gRPC module", "err", err)
+		return false, failureConfig
+	}
+	dialContext := func(ctx context.Context, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	// Block until connected, so that connection failures are reported as
+	// such rather than as a failed call.  A refused connection fails the dial
+	// right away instead of being retried until the timeout.
+	dialStart := time.Now()
+	conn, err := grpc.DialContext(ctx, target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithContextDialer(dialContext),
+		grpc.WithBlock(),
+		grpc.FailOnNonTempDialError(true),
+		grpc.WithReturnConnectionError(),
+	)
+	if err != nil {
+		module.logger.Warn("Error dialing", "err", err)
+		return false, errorFailureReason(err, failureConnect)
+	}
+	defer conn.Close()
+	metrics <- Metric{"probe_grpc_connect_duration_seconds", time.Since(dialStart).Seconds(), nil}
+
+	if len(config.Metadata) > 0 {
+		md := metadata.MD{}
+		for key, value := range config.Metadata {
+			md.Set(key, string(value))
+		}
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+	client := grpc_health_v1.NewHealthClient(conn)
+	callStart := time.Now()
+	resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: config.Service})
+	metrics <- Metric{"probe_grpc_duration_seconds", time.Since(callStart).Seconds(), nil}
+	if err != nil {
+		s, _ := status.FromError(err)
+		metrics <- Metric{"probe_grpc_status_code", float64(s.Code()), nil}
+		reason := failureProtocol
+		switch s.Code() {
+		case codes.Unimplemented:
+			module.logger.Warn("Target does not implement the gRPC health checking protocol")
+		case codes.NotFound:
+			// The server does not know about the service.
+			module.logger.Warn("Unknown service", "service", config.Service)
+			reason = failureNotServing
+		case codes.DeadlineExceeded:
+			module.logger.Warn("Timeout checking health of service", "service", config.Service)
+			reason = failureTimeout
+		default:
+			module.logger.Warn("Error checking health of service", "service", config.Service, "err", err)
+		}
+		return false, reason
+	}
+	metrics <- Metric{"probe_grpc_status_code", float64(codes.OK), nil}
+
+	// Report every known serving status, so that the current one can be
+	// selected with a label matcher.
+	for value := int32(0); value < int32(len(grpc_health_v1.HealthCheckResponse_ServingStatus_name)); value++ {
+		name := grpc_health_v1.HealthCheckResponse_ServingStatus_name[value]
+		v := 0.0
+		if grpc_health_v1.HealthCheckResponse_ServingStatus(value) == resp.Status {
+			v = 1
+		}
+		metrics <- Metric{"probe_grpc_healthcheck_response", v, map[string]string{"serving_status": name}}
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		module.logger.Info("Service is not serving", "service", config.Service, "status", resp.Status)
+		return false, failureNotServing
+	}
+	return true, ""
+}
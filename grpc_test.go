@@ -0,0 +1,109 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestGRPCHealthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	var token string
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md["authorization"]) > 0 {
+			token = md["authorization"][0]
+		}
+		return handler(ctx, req)
+	}))
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("users", grpc_health_v1.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("orders", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	for _, test := range []struct {
+		service string
+		success bool
+		status  string
+	}{
+		{"users", true, "SERVING"},
+		{"orders", false, "NOT_SERVING"},
+		// Unknown services are reported as a NotFound error.
+		{"missing", false, ""},
+	} {
+		module := Module{
+			Timeout: time.Second,
+			GRPC: GRPCProbe{
+				Service:  test.service,
+				Metadata: map[string]secret{"authorization": "Bearer secret"},
+			},
+		}
+		metrics := make(chan Metric, 100)
+		if success, _ := probeGRPC(ln.Addr().String(), module, metrics); success != test.success {
+			t.Fatalf("Unexpected result for service %q, want success %t", test.service, test.success)
+		}
+		close(metrics)
+		var status string
+		for m := range metrics {
+			if m.Name == "probe_grpc_healthcheck_response" && m.FloatValue == 1 {
+				status = m.Labels["serving_status"]
+			}
+		}
+		if status != test.status {
+			t.Fatalf("Unexpected serving status for service %q: got %q, want %q", test.service, status, test.status)
+		}
+		if token != "Bearer secret" {
+			t.Fatalf("Unexpected authorization metadata: got %q", token)
+		}
+	}
+}
+
+func TestGRPCConnectionFails(t *testing.T) {
+	// Closed ports should cause the probe to fail right away.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	module := Module{Timeout: 5 * time.Second}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	start := time.Now()
+	success, failure := probeGRPC(addr, module, metrics)
+	if success {
+		t.Fatalf("gRPC module suceeded, expected failure.")
+	}
+	if failure != failureConnect {
+		t.Fatalf("Unexpected failure reason: got %q, want %q", failure, failureConnect)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("gRPC module took %s to fail on a closed port, expected it to fail well before the timeout.", elapsed)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeHistoryEntry is a probe that has run, along with what it logged.
+type probeHistoryEntry struct {
+	ID       uint64
+	Module   string
+	Targets  []string
+	Success  bool
+	Start    time.Time
+	Duration time.Duration
+	Lines    []string
+}
+
+// probeHistory keeps the most recent probes in a ring buffer.
+type probeHistory struct {
+	mu      sync.Mutex
+	limit   int
+	entries []probeHistoryEntry
+	// next is the ID of the next entry, which also goes at next % limit.
+	next uint64
+}
+
+func newProbeHistory(limit int) *probeHistory {
+	return &probeHistory{limit: limit}
+}
+
+func (h *probeHistory) add(entry probeHistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.limit <= 0 {
+		return
+	}
+	entry.ID = h.next
+	if len(h.entries) < h.limit {
+		h.entries = append(h.entries, entry)
+	} else {
+		h.entries[h.next%uint64(h.limit)] = entry
+	}
+	h.next++
+}
+
+// list returns the entries, most recent first.
+func (h *probeHistory) list() []probeHistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := make([]probeHistoryEntry, 0, len(h.entries))
+	for i := 1; i <= len(h.entries); i++ {
+		entries = append(entries, h.entries[(h.next-uint64(i))%uint64(h.limit)])
+	}
+	return entries
+}
+
+// get returns the entry with an ID, if it is still kept.
+func (h *probeHistory) get(id uint64) (probeHistoryEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if id >= h.next || h.next-id > uint64(len(h.entries)) {
+		return probeHistoryEntry{}, false
+	}
+	return h.entries[id%uint64(h.limit)], true
+}
+
+var historyTemplate = template.Must(template.New("history").Parse(`<html>
+<head><title>Blackbox Exporter</title></head>
+<body>
+<h1>Blackbox Exporter</h1>
+<p><a href="/probe?target=prometheus.io&module=http_2xx">Probe prometheus.io for http_2xx</a></p>
+<p><a href="/metrics">Metrics</a></p>
+<h2>Recent Probes</h2>
+<table border="1" cellpadding="4">
+<tr><th>Module</th><th>Target</th><th>Result</th><th>Duration</th><th>Started</th><th>Logs</th></tr>
+{{range .}}<tr>
+<td>{{.Module}}</td>
+<td>{{range $i, $target := .Targets}}{{if $i}}<br>{{end}}{{$target}}{{end}}</td>
+<td>{{if .Success}}<span style="color:green">Success</span>{{else}}<span style="color:red">Failure</span>{{end}}</td>
+<td>{{.Duration}}</td>
+<td>{{.Start.Format "2006-01-02 15:04:05.000 MST"}}</td>
+<td><a href="/logs?id={{.ID}}">Logs</a></td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func historyHandler(w http.ResponseWriter, r *http.Request, history *probeHistory) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := historyTemplate.Execute(w, history.list()); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func logsHandler(w http.ResponseWriter, r *http.Request, history *probeHistory) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid probe id", 400)
+		return
+	}
+	entry, ok := history.get(id)
+	if !ok {
+		http.Error(w, "Probe not found, it may have been dropped from the history", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Logs for the probe of %s with module %s:\n", strings.Join(entry.Targets, ", "), entry.Module)
+	for _, line := range entry.Lines {
+		fmt.Fprintln(w, line)
+	}
+}
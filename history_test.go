@@ -0,0 +1,103 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeHistoryRing(t *testing.T) {
+	history := newProbeHistory(3)
+	if entries := history.list(); len(entries) != 0 {
+		t.Fatalf("Expected no entries, got %v", entries)
+	}
+	for _, module := range []string{"a", "b", "c", "d", "e"} {
+		history.add(probeHistoryEntry{Module: module})
+	}
+	var modules []string
+	for _, entry := range history.list() {
+		modules = append(modules, entry.Module)
+	}
+	if got := strings.Join(modules, ","); got != "e,d,c" {
+		t.Fatalf("Unexpected entries: got %s, want e,d,c", got)
+	}
+	if _, ok := history.get(1); ok {
+		t.Fatalf("Expected entry 1 to have been dropped")
+	}
+	if entry, ok := history.get(2); !ok || entry.Module != "c" {
+		t.Fatalf("Unexpected entry 2: %+v", entry)
+	}
+	if _, ok := history.get(5); ok {
+		t.Fatalf("Expected no entry 5")
+	}
+}
+
+func TestProbeHistoryPages(t *testing.T) {
+	target := closedPort(t, "tcp")
+	// The dial error is logged at debug level.
+	logger, err := newLogger(ioutil.Discard, "debug", "logfmt")
+	if err != nil {
+		t.Fatalf("Error creating logger: %s", err)
+	}
+	defer func(l *slog.Logger) { rootLogger = l }(rootLogger)
+	rootLogger = logger
+
+	config := &Config{Modules: map[string]Module{
+		"tcp_connect": {Prober: "tcp", Timeout: time.Second},
+	}}
+	history := newProbeHistory(10)
+	probeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/probe?module=tcp_connect&target="+target, nil), config, history)
+
+	w := httptest.NewRecorder()
+	historyHandler(w, httptest.NewRequest("GET", "/", nil), history)
+	body := w.Body.String()
+	for _, expected := range []string{
+		"<td>tcp_connect</td>",
+		"<td>" + target + "</td>",
+		"Failure",
+		"<a href=\"/logs?id=0\">",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in status page:\n%s", expected, body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	logsHandler(w, httptest.NewRequest("GET", "/logs?id=0", nil), history)
+	if body := w.Body.String(); !strings.Contains(body, "target="+target+" err=\"dial tcp ") {
+		t.Errorf("Expected the dial error in the logs:\n%s", body)
+	}
+
+	// Lines below the configured level are not kept.
+	if rootLogger, err = newLogger(ioutil.Discard, "info", "logfmt"); err != nil {
+		t.Fatalf("Error creating logger: %s", err)
+	}
+	probeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/probe?module=tcp_connect&target="+target, nil), config, history)
+	w = httptest.NewRecorder()
+	logsHandler(w, httptest.NewRequest("GET", "/logs?id=1", nil), history)
+	if body := w.Body.String(); strings.Contains(body, "dial tcp ") {
+		t.Errorf("Expected no debug lines in the logs:\n%s", body)
+	}
+
+	w = httptest.NewRecorder()
+	logsHandler(w, httptest.NewRequest("GET", "/logs?id=2", nil), history)
+	if w.Code != 404 {
+		t.Errorf("Expected 404 for an unknown probe, got %d", w.Code)
+	}
+}
@@ -3,37 +3,80 @@ package main
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/prometheus/log"
 )
 
-func matchRegularExpressions(body []byte, config HTTPProbe) bool {
+// captureNamedGroups adds the named capture groups of re matched in src to
+// captures.
+func captureNamedGroups(re *regexp.Regexp, src []byte, match []int, captures map[string]string) {
+	for i, name := range re.SubexpNames() {
+		if name != "" && match[2*i] >= 0 {
+			captures[name] = string(src[match[2*i]:match[2*i+1]])
+		}
+	}
+}
+
+// reportCaptures exports named capture groups, those listed in values as the
+// value of a <prefix>_capture_value{group} metric and all others as labels of
+// a <prefix>_capture_info metric.
+func reportCaptures(logger *probeLogger, prefix string, captures map[string]string, values []string, metrics chan<- Metric) {
+	labels := map[string]string{}
+	for name, capture := range captures {
+		labels[name] = capture
+	}
+	for _, name := range values {
+		capture, ok := labels[name]
+		if !ok {
+			continue
+		}
+		delete(labels, name)
+		value, err := strconv.ParseFloat(capture, 64)
+		if err != nil {
+			logger.Warn("Could not parse capture group value as a number", "group", name, "value", capture, "err", err)
+			continue
+		}
+		metrics <- Metric{prefix + "_capture_value", value, map[string]string{"group": name}}
+	}
+	if len(labels) > 0 {
+		metrics <- Metric{prefix + "_capture_info", 1, labels}
+	}
+}
+
+func matchRegularExpressions(logger *probeLogger, body []byte, config HTTPProbe, captures map[string]string) (bool, failureReason) {
 	for _, expression := range config.FailIfMatchesRegexp {
 		re, err := regexp.Compile(expression)
 		if err != nil {
-			log.Errorf("Could not compile expression %q as regular expression: %s", expression, err)
-			return false
+			logger.Error("Could not compile regular expression", "expression", expression, "err", err)
+			return false, failureConfig
 		}
 		if re.Match(body) {
-			return false
+			return false, failureRegexp
 		}
 	}
 	for _, expression := range config.FailIfNotMatchesRegexp {
 		re, err := regexp.Compile(expression)
 		if err != nil {
-			log.Errorf("Could not compile expression %q as regular expression: %s", expression, err)
-			return false
+			logger.Error("Could not compile regular expression", "expression", expression, "err", err)
+			return false, failureConfig
 		}
-		if !re.Match(body) {
-			return false
+		match := re.FindSubmatchIndex(body)
+		if match == nil {
+			return false, failureRegexp
 		}
+		captureNamedGroups(re, body, match, captures)
 	}
-	return true
+	return true, ""
 }
 
 func getEarliestCertExpiry(state *tls.ConnectionState) time.Time {
@@ -46,12 +89,120 @@ func getEarliestCertExpiry(state *tls.ConnectionState) time.Time {
 	return earliest
 }
 
-func probeHTTP(target string, module Module, metrics chan<- Metric) (success bool) {
+// httpTLSConfig returns the TLS settings for requests made by an HTTP probe.
+func httpTLSConfig(config HTTPProbe) *tls.Config {
+	return &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+}
+
+// newHTTPTransport returns a transport for requests made by an HTTP probe.
+func newHTTPTransport(module Module) (*http.Transport, error) {
+	dialer, err := newModuleDialer(module, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		DialContext:     dialer.DialContext,
+		TLSClientConfig: httpTLSConfig(module.HTTP),
+	}
+	// A proxy would be dialed at the pinned address instead of the target.
+	if module.address != "" {
+		transport.Proxy = nil
+	}
+	return transport, nil
+}
+
+// persistentHTTPTransports are the transports of modules using the persistent
+// connection mode, by module name and pinned address.
+var persistentHTTPTransports = struct {
+	sync.Mutex
+	m map[[2]string]*http.Transport
+}{m: map[[2]string]*http.Transport{}}
+
+// persistentHTTPTransport returns the transport shared by probes of a module,
+// creating it on first use.
+func persistentHTTPTransport(module Module) (*http.Transport, error) {
+	persistentHTTPTransports.Lock()
+	defer persistentHTTPTransports.Unlock()
+	key := [2]string{module.name, module.address}
+	if transport, ok := persistentHTTPTransports.m[key]; ok {
+		return transport, nil
+	}
+	transport, err := newHTTPTransport(module)
+	if err != nil {
+		return nil, err
+	}
+	persistentHTTPTransports.m[key] = transport
+	return transport, nil
+}
+
+// httpHeaders returns the headers to send with requests made by an HTTP probe.
+func httpHeaders(config HTTPProbe) http.Header {
+	header := http.Header{}
+	for name, value := range config.Headers {
+		header.Set(name, string(value))
+	}
+	return header
+}
+
+// httpCookies returns the static cookies to send with requests made by an
+// HTTP probe.
+func httpCookies(config HTTPProbe) []*http.Cookie {
+	names := make([]string, 0, len(config.Cookies))
+	for name := range config.Cookies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cookies := make([]*http.Cookie, 0, len(names))
+	for _, name := range names {
+		// Without a path, a cookie jar only sends a cookie to the directory
+		// of the URL it was set for.
+		cookies = append(cookies, &http.Cookie{Name: name, Value: string(config.Cookies[name]), Path: "/"})
+	}
+	return cookies
+}
+
+// httpErrorFailureReason classifies the error of an HTTP request which got no
+// response.
+func httpErrorFailureReason(err error) failureReason {
+	if isTLSError(err) {
+		return failureTLS
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return errorFailureReason(err, failureConnect)
+	}
+	return errorFailureReason(err, failureIO)
+}
+
+func probeHTTP(target string, module Module, metrics chan<- Metric) (success bool, reason failureReason) {
 	var redirects int
 	config := module.HTTP
 
+	if config.ConnectionMode == "" {
+		config.ConnectionMode = "new"
+	}
+	var transport *http.Transport
+	var err error
+	switch config.ConnectionMode {
+	case "new":
+		if transport, err = newHTTPTransport(module); err == nil {
+			transport.DisableKeepAlives = true
+			defer transport.CloseIdleConnections()
+		}
+	case "persistent":
+		transport, err = persistentHTTPTransport(module)
+	default:
+		err = fmt.Errorf("unknown connection mode %q", config.ConnectionMode)
+	}
+	if err != nil {
+		module.logger.Error("Error in HTTP module", "err", err)
+		return false, failureConfig
+	}
+	metrics <- Metric{"probe_http_connection_mode_info", 1, map[string]string{"mode": config.ConnectionMode}}
 	client := &http.Client{
-		Timeout: module.Timeout,
+		Timeout:   module.Timeout,
+		Transport: transport,
 	}
 
 	client.CheckRedirect = func(_ *http.Request, via []*http.Request) error {
@@ -75,27 +226,67 @@ func probeHTTP(target string, module Module, metrics chan<- Metric) (success boo
 		config.Path = "/"
 	}
 
-	log.Infof("probeHTTP to %s%s", target, config.Path)
+	module.logger.Debug("Making HTTP request", "url", target+config.Path)
 
 	request, err := http.NewRequest(config.Method, target+config.Path, nil)
 	if err != nil {
-		log.Errorf("Error creating request for target %s: %s", target, err)
-		return
+		module.logger.Error("Error creating request", "err", err)
+		return false, failureConfig
 	}
+	request.Header = httpHeaders(config)
+	// The Host header is ignored by the client unless set on the request.
+	if host := request.Header.Get("Host"); host != "" {
+		request.Host = host
+	}
+	if config.CookieJar {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			module.logger.Error("Error creating cookie jar", "err", err)
+			return false, failureConfig
+		}
+		// Static cookies go into the jar, so that they are sent along
+		// redirects to the same host too.
+		jar.SetCookies(request.URL, httpCookies(config))
+		client.Jar = jar
+	} else {
+		for _, cookie := range httpCookies(config) {
+			request.AddCookie(cookie)
+		}
+	}
+
+	// Report whether the first request went over a reused connection, which
+	// never happens in the new connection mode.
+	var gotConn bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !gotConn {
+				gotConn = true
+				if info.Reused {
+					metrics <- Metric{"probe_http_connection_reused", 1, nil}
+				} else {
+					metrics <- Metric{"probe_http_connection_reused", 0, nil}
+				}
+			}
+		},
+	}
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
 
 	resp, err := client.Do(request)
 	// Err won't be nil if redirects were turned off. See https://github.com/golang/go/issues/3795
 	if err != nil && resp == nil {
-		log.Warnf("Error for HTTP request to %s: %s", target, err)
+		module.logger.Warn("Error for HTTP request", "err", err)
+		reason = httpErrorFailureReason(err)
 	} else {
 		defer resp.Body.Close()
+		module.logger.Debug("Received HTTP response", "status_code", resp.StatusCode)
 
-		metrics <- Metric{"probe_http_status_code", float64(resp.StatusCode)}
-		metrics <- Metric{"probe_http_content_length", float64(resp.ContentLength)}
-		metrics <- Metric{"probe_http_redirects", float64(redirects)}
+		metrics <- Metric{"probe_http_status_code", float64(resp.StatusCode), nil}
+		metrics <- Metric{"probe_http_content_length", float64(resp.ContentLength), nil}
+		metrics <- Metric{"probe_http_redirects", float64(redirects), nil}
 
 		var statusCodeOkay = false
 		var regexMatchOkay = true
+		var regexReason failureReason
 		var tlsOkay = true
 
 		// First, check the status code of the response.
@@ -117,32 +308,44 @@ func probeHTTP(target string, module Module, metrics chan<- Metric) (success boo
 			body, err := ioutil.ReadAll(resp.Body)
 			if err == nil {
 
-				metrics <- Metric{"probe_http_actual_content_length", float64(len(body))}
+				metrics <- Metric{"probe_http_actual_content_length", float64(len(body)), nil}
 				if len(config.FailIfMatchesRegexp) > 0 || len(config.FailIfNotMatchesRegexp) > 0 {
-					regexMatchOkay = matchRegularExpressions(body, config)
+					captures := map[string]string{}
+					regexMatchOkay, regexReason = matchRegularExpressions(module.logger, body, config, captures)
+					reportCaptures(module.logger, "probe_http", captures, config.CaptureValues, metrics)
 				}
 			} else {
-				log.Errorf("Error reading HTTP body: %s", err)
+				module.logger.Error("Error reading HTTP body", "err", err)
 			}
 		}
 
 		// Finally check TLS
 
 		if resp.TLS != nil {
-			metrics <- Metric{"probe_http_ssl", 1.0}
+			metrics <- Metric{"probe_http_ssl", 1.0, nil}
 			metrics <- Metric{"probe_ssl_earliest_cert_expiry",
-				float64(getEarliestCertExpiry(resp.TLS).UnixNano()) / 1e9}
+				float64(getEarliestCertExpiry(resp.TLS).UnixNano()) / 1e9, nil}
 			if config.FailIfSSL {
 				tlsOkay = false
 			}
 		} else {
-			metrics <- Metric{"probe_http_ssl", 0.0}
+			metrics <- Metric{"probe_http_ssl", 0.0, nil}
 			if config.FailIfNotSSL {
 				tlsOkay = false
 			}
 		}
 
 		success = statusCodeOkay && regexMatchOkay && tlsOkay
+		switch {
+		case !statusCodeOkay:
+			reason = failureStatusCode
+		case !regexMatchOkay:
+			reason = regexReason
+		case !tlsOkay && resp.TLS != nil:
+			reason = failureSSLForbidden
+		case !tlsOkay:
+			reason = failureSSLRequired
+		}
 	}
 	return
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var httpFlowVariable = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// expandHTTPFlowVariables replaces ${name} with the values extracted by
+// earlier steps, escaped by escape if given, leaving unknown variables as they
+// are.
+func expandHTTPFlowVariables(logger *probeLogger, s string, variables map[string]string, escape func(string) string) string {
+	return httpFlowVariable.ReplaceAllStringFunc(s, func(v string) string {
+		if value, ok := variables[v[2:len(v)-1]]; ok {
+			if escape != nil {
+				return escape(value)
+			}
+			return value
+		}
+		logger.Debug("Unknown variable", "variable", v)
+		return v
+	})
+}
+
+// expandHTTPFlowPath expands the variables in a path, escaping their values
+// for the path or the query string, depending on which they are in.
+func expandHTTPFlowPath(logger *probeLogger, path string, variables map[string]string) string {
+	query := ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i:]
+	}
+	return expandHTTPFlowVariables(logger, path, variables, url.PathEscape) + expandHTTPFlowVariables(logger, query, variables, url.QueryEscape)
+}
+
+// jsonPathLookup returns the value at a dotted path such as $.items[0].id in
+// a JSON document, formatted as a string.
+func jsonPathLookup(body []byte, path string) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.Replace(strings.Replace(path, "[", ".", -1), "]", "", -1)
+	if path != "" {
+		for _, element := range strings.Split(path, ".") {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				var ok bool
+				if value, ok = v[element]; !ok {
+					return "", fmt.Errorf("no key %q", element)
+				}
+			case []interface{}:
+				i, err := strconv.Atoi(element)
+				if err != nil || i < 0 || i >= len(v) {
+					return "", fmt.Errorf("no index %q", element)
+				}
+				value = v[i]
+			default:
+				return "", fmt.Errorf("cannot look up %q in a scalar", element)
+			}
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case nil:
+		return "", errors.New("value is null")
+	}
+	s, err := json.Marshal(value)
+	return string(s), err
+}
+
+// UnmarshalYAML compiles the regexp when the config is loaded, so that an
+// invalid one is reported then rather than by every probe.
+func (e *HTTPFlowExtract) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain HTTPFlowExtract
+	if err := unmarshal((*plain)(e)); err != nil {
+		return err
+	}
+	return e.compile()
+}
+
+// compile compiles the regexp, unless the value is extracted by JSON path or
+// the regexp is already compiled.
+func (e *HTTPFlowExtract) compile() error {
+	if e.JSONPath != "" || e.re != nil {
+		return nil
+	}
+	if e.Regexp == "" {
+		return fmt.Errorf("extract %q needs regexp or json_path", e.Name)
+	}
+	re, err := regexp.Compile(e.Regexp)
+	if err != nil {
+		return fmt.Errorf("invalid regexp for %s: %s", e.Name, err)
+	}
+	e.re = re
+	return nil
+}
+
+// extract extracts a value from a response body, which is the first capture
+// group of the regexp, or the whole match if it has none.
+func (e HTTPFlowExtract) extract(body []byte) (string, error) {
+	if e.JSONPath != "" {
+		return jsonPathLookup(body, e.JSONPath)
+	}
+	match := e.re.FindSubmatch(body)
+	if match == nil {
+		return "", fmt.Errorf("%q did not match", e.Regexp)
+	}
+	if len(match) > 1 {
+		return string(match[1]), nil
+	}
+	return string(match[0]), nil
+}
+
+func httpFlowStepLabels(i int, step HTTPFlowStep) map[string]string {
+	name := step.Name
+	if name == "" {
+		name = strconv.Itoa(i)
+	}
+	return map[string]string{"step": name}
+}
+
+func probeHTTPFlow(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	deadline := time.Now().Add(module.Timeout)
+	lastStep := -1
+	defer func() {
+		metrics <- Metric{"probe_http_flow_last_successful_step", float64(lastStep), nil}
+	}()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return false, failureConfig
+	}
+	// Steps may reuse connections, but none are kept once the flow is done.
+	transport, err := newHTTPTransport(module)
+	if err != nil {
+		module.logger.Error("Error in HTTP flow module", "err", err)
+		return false, failureConfig
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Jar: jar, Transport: transport}
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		target = "http://" + target
+	}
+	if len(module.HTTP.Cookies) > 0 {
+		u, err := url.Parse(target)
+		if err != nil {
+			module.logger.Error("Error parsing target", "err", err)
+			return false, failureConfig
+		}
+		jar.SetCookies(u, httpCookies(module.HTTP))
+	}
+
+	// Regexps are compiled when the config is loaded, but modules that were
+	// not loaded from it need theirs compiled before running any step.
+	steps := make([]HTTPFlowStep, len(module.HTTPFlow.Steps))
+	for i, step := range module.HTTPFlow.Steps {
+		step.Extract = append([]HTTPFlowExtract(nil), step.Extract...)
+		for j := range step.Extract {
+			if err := step.Extract[j].compile(); err != nil {
+				module.logger.Error("Error in HTTP flow module", "step", i, "err", err)
+				return false, failureConfig
+			}
+		}
+		steps[i] = step
+	}
+
+	variables := map[string]string{}
+	for i, step := range steps {
+		labels := httpFlowStepLabels(i, step)
+		if step.Method == "" {
+			step.Method = "GET"
+		}
+		if step.Path == "" {
+			step.Path = "/"
+		}
+		// Steps share the module timeout.
+		client.Timeout = deadline.Sub(time.Now())
+		if client.Timeout <= 0 {
+			module.logger.Warn("Timeout before step of flow", "step", i)
+			return false, failureTimeout
+		}
+
+		stepURL := target + expandHTTPFlowPath(module.logger, step.Path, variables)
+		request, err := http.NewRequest(step.Method, stepURL, strings.NewReader(expandHTTPFlowVariables(module.logger, step.Body, variables, nil)))
+		if err != nil {
+			module.logger.Error("Error creating request for step of flow", "step", i, "err", err)
+			return false, failureConfig
+		}
+		request.Header = httpHeaders(module.HTTP)
+		for name, value := range step.Headers {
+			request.Header.Set(name, expandHTTPFlowVariables(module.logger, string(value), variables, nil))
+		}
+		if host := request.Header.Get("Host"); host != "" {
+			request.Host = host
+		}
+
+		module.logger.Debug("Running step of flow", "step", i, "method", step.Method, "url", stepURL)
+		start := time.Now()
+		resp, err := client.Do(request)
+		if err != nil {
+			module.logger.Warn("Error for step of flow", "step", i, "err", err)
+			return false, httpErrorFailureReason(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		metrics <- Metric{"probe_http_flow_step_duration_seconds", time.Since(start).Seconds(), labels}
+		metrics <- Metric{"probe_http_flow_step_status_code", float64(resp.StatusCode), labels}
+		if err != nil {
+			module.logger.Warn("Error reading body for step of flow", "step", i, "err", err)
+			return false, errorFailureReason(err, failureIO)
+		}
+
+		statusCodeOkay := false
+		if len(step.ValidStatusCodes) != 0 {
+			for _, code := range step.ValidStatusCodes {
+				if resp.StatusCode == code {
+					statusCodeOkay = true
+					break
+				}
+			}
+		} else if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+			statusCodeOkay = true
+		}
+		if !statusCodeOkay {
+			module.logger.Warn("Unexpected status code for step of flow", "step", i, "status_code", resp.StatusCode)
+			return false, failureStatusCode
+		}
+
+		for _, e := range step.Extract {
+			value, err := e.extract(body)
+			if err != nil {
+				module.logger.Warn("Error extracting value in step of flow", "step", i, "name", e.Name, "err", err)
+				return false, failureRegexp
+			}
+			variables[e.Name] = value
+		}
+		lastStep = i
+	}
+	return true, ""
+}
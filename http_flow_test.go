@@ -0,0 +1,212 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestHTTPFlowLoginCreateRead(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("password") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		fmt.Fprintf(w, "<input name=\"csrf\" value=\"token-123\">")
+	})
+	mux.HandleFunc("/items", func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session")
+		if err != nil || cookie.Value != "s1" || r.Header.Get("X-CSRF-Token") != "token-123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "{\"item\": {\"id\": 42, \"tags\": [\"a\", %q]}}", body)
+	})
+	mux.HandleFunc("/items/42", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("tag") != "created" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	steps := []HTTPFlowStep{
+		{
+			Name: "login", Method: "POST", Path: "/login",
+			Headers: map[string]secret{"Content-Type": "application/x-www-form-urlencoded"},
+			Body:    "user=prober&password=secret",
+			Extract: []HTTPFlowExtract{{Name: "csrf", Regexp: "name=\"csrf\" value=\"([^\"]+)\""}},
+		},
+		{
+			Name: "create", Method: "POST", Path: "/items", Body: "created",
+			Headers:          map[string]secret{"X-CSRF-Token": "${csrf}"},
+			ValidStatusCodes: []int{201},
+			Extract: []HTTPFlowExtract{
+				{Name: "id", JSONPath: "$.item.id"},
+				{Name: "tag", JSONPath: "$.item.tags[1]"},
+			},
+		},
+		{Path: "/items/${id}?tag=${tag}"},
+	}
+	metrics := make(chan Metric, 100)
+	if success, _ := probeHTTPFlow(ts.URL, Module{Timeout: time.Second, HTTPFlow: HTTPFlowProbe{Steps: steps}}, metrics); !success {
+		t.Fatalf("HTTP flow module failed, expected success.")
+	}
+	close(metrics)
+	var steps2xx string
+	lastStep := -2.0
+	for m := range metrics {
+		switch m.Name {
+		case "probe_http_flow_step_status_code":
+			steps2xx += fmt.Sprintf("%s=%.0f ", m.Labels["step"], m.FloatValue)
+		case "probe_http_flow_last_successful_step":
+			lastStep = m.FloatValue
+		}
+	}
+	if steps2xx != "login=200 create=201 2=200 " || lastStep != 2 {
+		t.Fatalf("Unexpected step results: %q, last successful step %f", steps2xx, lastStep)
+	}
+
+	// Without the session cookie the second step fails.
+	steps[0].Body = "user=prober&password=wrong"
+	steps[0].ValidStatusCodes = []int{403}
+	steps[0].Extract = nil
+	metrics = make(chan Metric, 100)
+	if success, _ := probeHTTPFlow(ts.URL, Module{Timeout: time.Second, HTTPFlow: HTTPFlowProbe{Steps: steps}}, metrics); success {
+		t.Fatalf("HTTP flow module succeeded, expected failure.")
+	}
+	close(metrics)
+	for m := range metrics {
+		if m.Name == "probe_http_flow_last_successful_step" && m.FloatValue != 0 {
+			t.Fatalf("Unexpected last successful step: got %f, want 0", m.FloatValue)
+		}
+	}
+}
+
+func TestJSONPathLookup(t *testing.T) {
+	body := []byte(`{"a": {"b": [1, {"c": "d"}], "e": true, "f": 1.5e3, "g": null}}`)
+	for _, test := range []struct {
+		path, value string
+		ok          bool
+	}{
+		{"$.a.b[1].c", "d", true},
+		{"a.b.0", "1", true},
+		{"$.a.e", "true", true},
+		{"$.a.f", "1.5e3", true},
+		{"$.a.b[1]", `{"c":"d"}`, true},
+		{"$.a.b[2]", "", false},
+		{"$.a.g", "", false},
+		{"$.a.x", "", false},
+	} {
+		value, err := jsonPathLookup(body, test.path)
+		if (err == nil) != test.ok || value != test.value {
+			t.Fatalf("Unexpected value for %s: got %q, %v", test.path, value, err)
+		}
+	}
+}
+
+func TestHTTPFlowEscapesVariables(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/start":
+			fmt.Fprintf(w, "value=a b/c&d")
+		case r.URL.EscapedPath() != "/items/a%20b%2Fc&d" || r.URL.Query().Get("q") != "a b/c&d":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	steps := []HTTPFlowStep{
+		{Path: "/start", Extract: []HTTPFlowExtract{{Name: "value", Regexp: "value=(.*)"}}},
+		{Path: "/items/${value}?q=${value}"},
+	}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, _ := probeHTTPFlow(ts.URL, Module{Timeout: time.Second, HTTPFlow: HTTPFlowProbe{Steps: steps}}, metrics); !success {
+		t.Fatalf("HTTP flow module failed with escaped variables, expected success.")
+	}
+}
+
+func TestHTTPFlowInvalidExtractRegexp(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+
+	steps := []HTTPFlowStep{
+		{Path: "/"},
+		{Path: "/", Extract: []HTTPFlowExtract{{Name: "broken", Regexp: "("}}},
+	}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	success, failure := probeHTTPFlow(ts.URL, Module{Timeout: time.Second, HTTPFlow: HTTPFlowProbe{Steps: steps}}, metrics)
+	if success {
+		t.Fatalf("HTTP flow module succeeded with an invalid regexp, expected failure.")
+	}
+	if failure != failureConfig {
+		t.Fatalf("Unexpected failure reason: got %q, want %q", failure, failureConfig)
+	}
+	if requests != 0 {
+		t.Fatalf("Unexpected requests before failing on an invalid regexp: got %d, want 0", requests)
+	}
+
+	config := `
+modules:
+  flow:
+    prober: http_flow
+    http_flow:
+      steps:
+      - extract:
+        - name: broken
+          regexp: "("
+`
+	if err := yaml.Unmarshal([]byte(config), &Config{}); err == nil {
+		t.Fatalf("Loading a config with an invalid extract regexp succeeded, expected an error.")
+	}
+}
+
+func TestHTTPFlowExtractNeedsRegexpOrJSONPath(t *testing.T) {
+	steps := []HTTPFlowStep{{Path: "/", Extract: []HTTPFlowExtract{{Name: "token"}}}}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, failure := probeHTTPFlow("http://localhost", Module{Timeout: time.Second, HTTPFlow: HTTPFlowProbe{Steps: steps}}, metrics); success || failure != failureConfig {
+		t.Fatalf("HTTP flow module with an empty extract returned %v with reason %q, expected a config failure.", success, failure)
+	}
+
+	config := `
+modules:
+  flow:
+    prober: http_flow
+    http_flow:
+      steps:
+      - extract:
+        - name: token
+`
+	if err := yaml.Unmarshal([]byte(config), &Config{}); err == nil || !strings.Contains(err.Error(), `extract "token" needs regexp or json_path`) {
+		t.Fatalf("Unexpected error loading a config with an empty extract: %v", err)
+	}
+}
@@ -46,11 +46,14 @@ func TestHTTPStatusCodes(t *testing.T) {
 		defer ts.Close()
 		metrics := NewMetricSink()
 		defer close(metrics)
-		result := probeHTTP(ts.URL,
+		result, reason := probeHTTP(ts.URL,
 			Module{HTTP: HTTPProbe{ValidStatusCodes: test.ValidStatusCodes}}, metrics)
 		if result != test.ShouldSucceed {
 			t.Fatalf("Test %d (status code %d) expected result %t, got %t", i, test.StatusCode, test.ShouldSucceed, result)
 		}
+		if !result && reason != failureStatusCode {
+			t.Fatalf("Test %d (status code %d) expected failure reason %q, got %q", i, test.StatusCode, failureStatusCode, reason)
+		}
 	}
 }
 
@@ -65,7 +68,7 @@ func TestConfiguredPathSentInRequest(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL, Module{HTTP: HTTPProbe{Path: pathToSend}}, metrics)
+	result, _ := probeHTTP(ts.URL, Module{HTTP: HTTPProbe{Path: pathToSend}}, metrics)
 	if !result {
 		t.Error()
 	}
@@ -85,22 +88,26 @@ func TestRedirectFollowed(t *testing.T) {
 
 	// Follow redirect, should succeed with 200.
 	metrics := make(chan Metric)
-	defer close(metrics)
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		var redirectMetricFound = false
 		for m := range metrics {
 			if m.Name == "probe_http_redirects" {
+				redirectMetricFound = true
 				if m.FloatValue != 1.0 {
-					t.Fatalf("Unexpected number of redirects found: %f", m.FloatValue)
+					t.Errorf("Unexpected number of redirects found: %f", m.FloatValue)
 				}
 			}
 		}
 		if !redirectMetricFound {
-			t.Fatalf("Redirect count metric not found.")
+			t.Errorf("Redirect count metric not found.")
 		}
 	}()
 
-	result := probeHTTP(ts.URL, Module{HTTP: HTTPProbe{}}, metrics)
+	result, _ := probeHTTP(ts.URL, Module{HTTP: HTTPProbe{}}, metrics)
+	close(metrics)
+	<-done
 	if !result {
 		t.Fail()
 	}
@@ -115,7 +122,7 @@ func TestRedirectNotFollowed(t *testing.T) {
 	// Follow redirect, should succeed with 200.
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, _ := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{NoFollowRedirects: true, ValidStatusCodes: []int{302}}}, metrics)
 	if !result {
 		t.Fail()
@@ -132,7 +139,7 @@ func TestPost(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, _ := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{Method: "POST"}}, metrics)
 	if !result {
 		t.Fail()
@@ -152,11 +159,14 @@ func TestFailIfNotSSL(t *testing.T) {
 			}
 		}
 	}()
-	result := probeHTTP(ts.URL,
+	result, reason := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{FailIfNotSSL: true}}, metrics)
 	if result {
 		t.Fail()
 	}
+	if reason != failureSSLRequired {
+		t.Fatalf("Unexpected failure reason: got %q, want %q", reason, failureSSLRequired)
+	}
 }
 
 func TestFailIfMatchesRegexpShouldFailOnMatch(t *testing.T) {
@@ -167,11 +177,14 @@ func TestFailIfMatchesRegexpShouldFailOnMatch(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, reason := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{FailIfMatchesRegexp: []string{"string in the body"}}}, metrics)
 	if result {
 		t.Fail()
 	}
+	if reason != failureRegexp {
+		t.Fatalf("Unexpected failure reason: got %q, want %q", reason, failureRegexp)
+	}
 }
 
 func TestFailIfMatchesRegexpShouldNotFailOnNoMatch(t *testing.T) {
@@ -182,7 +195,7 @@ func TestFailIfMatchesRegexpShouldNotFailOnNoMatch(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, _ := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{FailIfMatchesRegexp: []string{"string NOT in the body"}}}, metrics)
 	if !result {
 		t.Fail()
@@ -199,7 +212,7 @@ func TestFailIfMatchesRegexpShouldFailOnAnyMatch(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, _ := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{FailIfMatchesRegexp: []string{"string NOT in the body", "string in the body"}}}, metrics)
 	if result {
 		t.Fail()
@@ -214,7 +227,7 @@ func TestFailIfMatchesRegexpShouldNotFailOnNoMatches(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, _ := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{FailIfMatchesRegexp: []string{"string NOT in the body", "string also NOT in the body"}}}, metrics)
 	if !result {
 		t.Fail()
@@ -229,7 +242,7 @@ func TestFailIfNotMatchesRegexpShouldFailOnNoMatch(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, _ := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{FailIfNotMatchesRegexp: []string{"string NOT in the body"}}}, metrics)
 	if result {
 		t.Fail()
@@ -244,7 +257,7 @@ func TestFailIfNotMatchesRegexpShouldNotFailOnMatch(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, _ := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{FailIfNotMatchesRegexp: []string{"string in the body"}}}, metrics)
 	if !result {
 		t.Fail()
@@ -261,7 +274,7 @@ func TestFailIfNotMatchesRegexpShouldFailOnAnyNonMatches(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, _ := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{FailIfNotMatchesRegexp: []string{"string in the body", "string NOT in the body"}}}, metrics)
 	if result {
 		t.Fail()
@@ -276,9 +289,134 @@ func TestFailIfNotMatchesRegexpShouldNotFailOnAllMatches(t *testing.T) {
 
 	metrics := NewMetricSink()
 	defer close(metrics)
-	result := probeHTTP(ts.URL,
+	result, _ := probeHTTP(ts.URL,
 		Module{HTTP: HTTPProbe{FailIfNotMatchesRegexp: []string{"string in the", "body of the"}}}, metrics)
 	if !result {
 		t.Fail()
 	}
 }
+
+func TestFailIfNotMatchesRegexpCaptures(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "status: ok\nversion: 1.2.3\nqueue depth: 42\n")
+	}))
+	defer ts.Close()
+
+	metrics := make(chan Metric, 100)
+	result, _ := probeHTTP(ts.URL,
+		Module{HTTP: HTTPProbe{
+			FailIfNotMatchesRegexp: []string{"version: (?P<version>\\S+)", "queue depth: (?P<queue_depth>\\d+)"},
+			CaptureValues:          []string{"queue_depth"},
+		}}, metrics)
+	if !result {
+		t.Fatalf("HTTP module failed, expected success.")
+	}
+	close(metrics)
+	var version string
+	var queueDepth float64
+	for m := range metrics {
+		switch m.Name {
+		case "probe_http_capture_info":
+			version = m.Labels["version"]
+		case "probe_http_capture_value":
+			if m.Labels["group"] == "queue_depth" {
+				queueDepth = m.FloatValue
+			}
+		}
+	}
+	if version != "1.2.3" || queueDepth != 42 {
+		t.Fatalf("Unexpected captures: got version %q and queue depth %f", version, queueDepth)
+	}
+}
+
+func TestHeadersAndInsecureSkipVerify(t *testing.T) {
+	var authorization, host string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization, host = r.Header.Get("Authorization"), r.Host
+	}))
+	defer ts.Close()
+
+	metrics := NewMetricSink()
+	defer close(metrics)
+	config := HTTPProbe{Headers: map[string]secret{"Authorization": "Bearer secret", "Host": "example.com"}}
+	if success, _ := probeHTTP(ts.URL, Module{HTTP: config}, metrics); success {
+		t.Fatalf("HTTP module succeeded with an untrusted certificate, expected failure.")
+	}
+	config.InsecureSkipVerify = true
+	if success, _ := probeHTTP(ts.URL, Module{HTTP: config}, metrics); !success {
+		t.Fatalf("HTTP module failed, expected success.")
+	}
+	if authorization != "Bearer secret" || host != "example.com" {
+		t.Fatalf("Unexpected headers: got Authorization %q and Host %q", authorization, host)
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	// Like an SSO handshake, /sso/start sets a session cookie and redirects
+	// to /app, which requires it along with the static cookie.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sso/start", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+		http.Redirect(w, r, "/app", http.StatusFound)
+	})
+	mux.HandleFunc("/app", func(w http.ResponseWriter, r *http.Request) {
+		session, err := r.Cookie("session")
+		if err != nil || session.Value != "s1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if locale, err := r.Cookie("locale"); err != nil || locale.Value != "en" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	metrics := NewMetricSink()
+	defer close(metrics)
+	config := HTTPProbe{Path: "/sso/start", Cookies: map[string]secret{"locale": "en"}}
+	if success, _ := probeHTTP(ts.URL, Module{HTTP: config}, metrics); success {
+		t.Fatalf("HTTP module succeeded without a cookie jar, expected failure.")
+	}
+	config.CookieJar = true
+	if success, _ := probeHTTP(ts.URL, Module{HTTP: config}, metrics); !success {
+		t.Fatalf("HTTP module failed with a cookie jar, expected success.")
+	}
+}
+
+func TestConnectionModes(t *testing.T) {
+	remoteAddrs := map[string]bool{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs[r.RemoteAddr] = true
+	}))
+	defer ts.Close()
+
+	for _, test := range []struct {
+		mode        string
+		connections int
+		reused      float64
+	}{
+		{"new", 2, 0},
+		{"persistent", 1, 1},
+	} {
+		remoteAddrs = map[string]bool{}
+		module := Module{HTTP: HTTPProbe{ConnectionMode: test.mode}, name: "test_" + test.mode}
+		var reused float64
+		for i := 0; i < 2; i++ {
+			metrics := make(chan Metric, 100)
+			if success, _ := probeHTTP(ts.URL, module, metrics); !success {
+				t.Fatalf("HTTP module failed in %s connection mode, expected success.", test.mode)
+			}
+			close(metrics)
+			for m := range metrics {
+				if m.Name == "probe_http_connection_reused" {
+					reused = m.FloatValue
+				}
+			}
+		}
+		if len(remoteAddrs) != test.connections || reused != test.reused {
+			t.Fatalf("Unexpected connections in %s connection mode: got %d connections and reused %f, want %d and %f",
+				test.mode, len(remoteAddrs), reused, test.connections, test.reused)
+		}
+	}
+}
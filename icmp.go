@@ -4,12 +4,18 @@ import (
 	"bytes"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"net"
-	"os"
 	"sync"
 	"time"
+)
 
-	"github.com/prometheus/log"
+const (
+	// IANA protocol numbers, as expected by icmp.ParseMessage.
+	protocolICMP     = 1
+	protocolTCP      = 6
+	protocolUDP      = 17
+	protocolIPv6ICMP = 58
 )
 
 var (
@@ -24,71 +30,226 @@ func getICMPSequence() uint16 {
 	return icmpSequence
 }
 
-func probeICMP(target string, module Module, metrics chan<- Metric) (success bool) {
-	deadline := time.Now().Add(module.Timeout)
-	socket, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
-	if err != nil {
-		log.Errorf("Error listening to socket: %s", err)
-		return
+// icmpNetwork returns the network and listen address to pass to
+// icmp.ListenPacket for the configured IP protocol, listening on the source
+// address if given.  Unprivileged mode uses the Linux ping sockets
+// ("udp4"/"udp6"), which only require the process' group to be within
+// net.ipv4.ping_group_range rather than root or CAP_NET_RAW.
+func icmpNetwork(config ICMPProbe, source string) (network, address string) {
+	if config.Protocol == "ip6" {
+		network, address = "ip6:ipv6-icmp", "::"
+		if config.Unprivileged {
+			network = "udp6"
+		}
+	} else {
+		network, address = "ip4:icmp", "0.0.0.0"
+		if config.Unprivileged {
+			network = "udp4"
+		}
+	}
+	if source != "" {
+		address = source
 	}
-	defer socket.Close()
+	return network, address
+}
 
-	ip, err := net.ResolveIPAddr("ip4", target)
-	if err != nil {
-		log.Errorf("Error resolving address %s: %s", target, err)
-		return
+// peerIP extracts the IP address from the peer returned by ReadFrom, which is a
+// *net.IPAddr for raw sockets and a *net.UDPAddr for ping sockets.
+func peerIP(peer net.Addr) net.IP {
+	switch addr := peer.(type) {
+	case *net.IPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// icmpTypeNumber returns the numeric value of an ICMPv4 or ICMPv6 message type.
+func icmpTypeNumber(t icmp.Type) int {
+	switch t := t.(type) {
+	case ipv4.ICMPType:
+		return int(t)
+	case ipv6.ICMPType:
+		return int(t)
+	}
+	return -1
+}
+
+// icmpPayload returns an echo request payload of size bytes.
+func icmpPayload(size int) []byte {
+	pattern := []byte("Prometheus Blackbox Exporter")
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = pattern[i%len(pattern)]
 	}
+	return data
+}
 
-	seq := getICMPSequence()
-	pid := os.Getpid() & 0xffff
+// isICMPEchoReply reports whether reply is an intact echo reply to a request
+// carrying data.
+func isICMPEchoReply(reply *icmpReply, data []byte) bool {
+	echo, ok := reply.message.Body.(*icmp.Echo)
+	// The reply should be the same as the request except for the message type.
+	return ok && bytes.Equal(echo.Data, data)
+}
 
+// sendICMPEcho sends an echo request carrying data to ip and waits for the
+// reply until deadline.  It returns nil if no reply arrived in time.
+func sendICMPEcho(socket *icmpSocket, ip *net.IPAddr, data []byte, deadline time.Time) (*icmpReply, error) {
+	key, replies, err := icmpListenerInstance.register(socket, ip.IP)
+	if err != nil {
+		return nil, err
+	}
+	defer icmpListenerInstance.unregister(key)
+
+	var requestType icmp.Type = ipv4.ICMPTypeEcho
+	if socket.proto == protocolIPv6ICMP {
+		requestType = ipv6.ICMPTypeEchoRequest
+	}
 	wm := icmp.Message{
-		Type: ipv4.ICMPTypeEcho, Code: 0,
+		Type: requestType, Code: 0,
 		Body: &icmp.Echo{
-			ID: pid, Seq: int(seq),
-			Data: []byte("Prometheus Blackbox Exporter"),
+			ID: key.id, Seq: key.seq,
+			Data: data,
 		},
 	}
 	wb, err := wm.Marshal(nil)
 	if err != nil {
-		log.Errorf("Error marshalling packet for %s: %s", target, err)
-		return
+		return nil, err
 	}
-	if _, err := socket.WriteTo(wb, ip); err != nil {
-		log.Errorf("Error writing to socker for %s: %s", target, err)
-		return
+	if _, err := socket.conn.WriteTo(wb, socket.destination(ip)); err != nil {
+		return nil, err
 	}
 
-	// Reply should be the same except for the message type.
-	wm.Type = ipv4.ICMPTypeEchoReply
-	wb, err = wm.Marshal(nil)
-	if err != nil {
-		log.Errorf("Error marshalling packet for %s: %s", target, err)
-		return
+	timeout := time.NewTimer(deadline.Sub(time.Now()))
+	defer timeout.Stop()
+	select {
+	case reply := <-replies:
+		return &reply, nil
+	case <-timeout.C:
+		return nil, nil
 	}
+}
 
-	rb := make([]byte, 1500)
-	if err := socket.SetReadDeadline(deadline); err != nil {
-		log.Errorf("Error setting socket deadline for %s: %s", target, err)
-		return
+// discoverICMPPathMTU binary searches for the largest payload of at most
+// maxPayload bytes which reaches ip without being fragmented.  It returns -1
+// if not even an empty payload gets a reply.
+func discoverICMPPathMTU(logger *probeLogger, socket *icmpSocket, ip *net.IPAddr, maxPayload int, deadline time.Time) int {
+	// Split the timeout evenly between the attempts the search may need, as
+	// black holes only show up as a timeout.
+	attempts := 2
+	for n := maxPayload; n > 0; n >>= 1 {
+		attempts++
 	}
-	for {
-		n, peer, err := socket.ReadFrom(rb)
+	attemptTimeout := deadline.Sub(time.Now()) / time.Duration(attempts)
+
+	fits := func(size int) bool {
+		data := icmpPayload(size)
+		reply, err := sendICMPEcho(socket, ip, data, time.Now().Add(attemptTimeout))
 		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-				log.Infof("Timeout reading from socket for %s: %s", target, err)
-				return
-			}
-			log.Errorf("Error reading from socket for %s: %s", target, err)
-			continue
+			// Sends larger than the path MTU known to the kernel fail with EMSGSIZE.
+			logger.Debug("Error sending ICMP echo request", "size", size, "ip", ip, "err", err)
+			return false
+		}
+		return reply != nil && isICMPEchoReply(reply, data)
+	}
+
+	if fits(maxPayload) {
+		return maxPayload
+	}
+	if !fits(0) {
+		return -1
+	}
+	low, high := 0, maxPayload-1
+	for low < high {
+		mid := (low + high + 1) / 2
+		if fits(mid) {
+			low = mid
+		} else {
+			high = mid - 1
 		}
-		if peer.String() != ip.String() {
-			continue
+	}
+	return low
+}
+
+func probeICMP(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	deadline := time.Now().Add(module.Timeout)
+	config := module.ICMP
+	if config.Protocol == "" {
+		config.Protocol = "ip4"
+	}
+	if config.Protocol != "ip4" && config.Protocol != "ip6" {
+		module.logger.Error("Unknown ICMP protocol", "protocol", config.Protocol)
+		return false, failureConfig
+	}
+	// The IPv4 total length includes the IP header, the IPv6 payload length
+	// doesn't.
+	headerLen, maxPayloadSize := ipv4.HeaderLen+8, 65535-ipv4.HeaderLen-8
+	if config.Protocol == "ip6" {
+		headerLen, maxPayloadSize = ipv6.HeaderLen+8, 65535-8
+	}
+	if config.PayloadSize < 0 || config.PayloadSize > maxPayloadSize {
+		module.logger.Error("ICMP payload size out of range", "payload_size", config.PayloadSize, "max", maxPayloadSize)
+		return false, failureConfig
+	}
+	if config.PayloadSize == 0 {
+		if config.DiscoverPathMTU {
+			config.PayloadSize = 1500 - headerLen
+		} else {
+			config.PayloadSize = len("Prometheus Blackbox Exporter")
 		}
-		if bytes.Compare(rb[:n], wb) == 0 {
-			success = true
-			return
+	}
+
+	network, address := icmpNetwork(config, module.SourceIPAddress)
+	socket, err := icmpListenerInstance.socket(network, address, module.BindToDevice, config.DontFragment || config.DiscoverPathMTU)
+	if err != nil {
+		module.logger.Error("Error listening to socket", "err", err)
+		return false, failureConfig
+	}
+
+	ip, err := resolveIPAddr(module, config.Protocol, target)
+	if err != nil {
+		module.logger.Error("Error resolving address", "err", err)
+		return false, errorFailureReason(err, failureDNS)
+	}
+	module.logger.Debug("Resolved target", "ip", ip)
+
+	if config.DiscoverPathMTU {
+		payload := discoverICMPPathMTU(module.logger, socket, ip, config.PayloadSize, deadline)
+		if payload < 0 {
+			module.logger.Info("No ICMP echo reply during path MTU discovery", "ip", ip)
+			return false, failureTimeout
 		}
+		metrics <- Metric{"probe_icmp_path_mtu_bytes", float64(headerLen + payload), nil}
+		return true, ""
+	}
+
+	data := icmpPayload(config.PayloadSize)
+	reply, err := sendICMPEcho(socket, ip, data, deadline)
+	if err != nil {
+		module.logger.Error("Error sending ICMP echo request", "ip", ip, "err", err)
+		return false, failureConnect
+	}
+	if reply == nil {
+		module.logger.Info("Timeout waiting for ICMP reply", "ip", ip)
+		return false, failureTimeout
+	}
+
+	metrics <- Metric{"probe_icmp_reply_type", float64(icmpTypeNumber(reply.message.Type)), nil}
+	metrics <- Metric{"probe_icmp_reply_code", float64(reply.message.Code), nil}
+	if reply.hopLimit >= 0 {
+		metrics <- Metric{"probe_icmp_reply_hop_limit", float64(reply.hopLimit), nil}
+	}
+	if _, ok := reply.message.Body.(*icmp.Echo); !ok {
+		// An error message quoting our request, e.g. destination unreachable
+		// or TTL exceeded, so no reply will follow.
+		module.logger.Warn("Received ICMP error", "type", reply.message.Type, "code", reply.message.Code, "peer", reply.peer, "ip", ip)
+		return false, failureUnreachable
+	}
+	if !isICMPEchoReply(reply, data) {
+		module.logger.Warn("Received ICMP echo reply with corrupted payload", "ip", ip)
+		return false, failureProtocol
 	}
-	return
+	return true, ""
 }
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"syscall"
+)
+
+// setDontFragment makes the kernel set the don't fragment bit on packets sent
+// over c, and fail sends larger than the known path MTU rather than fragment
+// them.
+func setDontFragment(c syscall.RawConn, ip6 bool) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if ip6 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// icmpKey identifies an outstanding request, so that replies read from a
+// shared socket can be dispatched to the probe waiting for them.  For echo
+// requests id and seq are the echo ID and sequence number, for UDP and TCP
+// packets quoted in ICMP errors they are the source and destination port.
+type icmpKey struct {
+	network string
+	// proto is the IANA protocol number of the request.
+	proto int
+	id    int
+	seq   int
+	peer  string
+}
+
+// icmpReply is an echo reply, or an error message quoting an echo request,
+// received for an outstanding request.
+type icmpReply struct {
+	message *icmp.Message
+	// peer is the sender of the message, which for error messages is usually
+	// a router on the path rather than the target.
+	peer net.IP
+	// hopLimit is the TTL or hop limit of the received packet, or -1 if unknown.
+	hopLimit int
+	received time.Time
+}
+
+// icmpSocket is a long-lived ICMP socket shared by all probes using the same
+// network and socket options.
+type icmpSocket struct {
+	network string
+	proto   int
+	// id is the echo ID used for requests on this socket.  For ping sockets
+	// this is the local port, as the kernel rewrites the ID of outgoing
+	// requests and only delivers replies carrying it.
+	id   int
+	conn net.PacketConn
+	p4   *ipv4.PacketConn
+	p6   *ipv6.PacketConn
+}
+
+type icmpSocketKey struct {
+	network      string
+	address      string
+	device       string
+	dontFragment bool
+}
+
+// icmpListener owns one socket per network and demultiplexes the replies
+// read from it, so that concurrent probes don't each have to read and discard
+// every ICMP packet on the host.
+type icmpListener struct {
+	mu      sync.Mutex
+	sockets map[icmpSocketKey]*icmpSocket
+	waiters map[icmpKey]chan icmpReply
+}
+
+var icmpListenerInstance = &icmpListener{
+	sockets: map[icmpSocketKey]*icmpSocket{},
+	waiters: map[icmpKey]chan icmpReply{},
+}
+
+func newICMPSocket(network, address, device string, dontFragment bool) (*icmpSocket, error) {
+	s := &icmpSocket{
+		network: network,
+		proto:   protocolICMP,
+		id:      os.Getpid() & 0xffff,
+	}
+	ip6 := network == "ip6:ipv6-icmp" || network == "udp6"
+	if ip6 {
+		s.proto = protocolIPv6ICMP
+	}
+
+	if network == "udp4" || network == "udp6" {
+		if dontFragment {
+			return nil, errors.New("don't fragment is not supported on unprivileged ICMP sockets")
+		}
+		if device != "" {
+			return nil, errors.New("binding to a device is not supported on unprivileged ICMP sockets")
+		}
+		conn, err := icmp.ListenPacket(network, address)
+		if err != nil {
+			return nil, err
+		}
+		s.conn, s.p4, s.p6 = conn, conn.IPv4PacketConn(), conn.IPv6PacketConn()
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			s.id = addr.Port
+		}
+	} else {
+		var lc net.ListenConfig
+		if dontFragment || device != "" {
+			lc.Control = func(_, _ string, c syscall.RawConn) error {
+				if device != "" {
+					if err := bindToDevice(c, device); err != nil {
+						return err
+					}
+				}
+				if dontFragment {
+					return setDontFragment(c, ip6)
+				}
+				return nil
+			}
+		}
+		conn, err := lc.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+		if ip6 {
+			s.p6 = ipv6.NewPacketConn(conn)
+		} else {
+			s.p4 = ipv4.NewPacketConn(conn)
+		}
+	}
+
+	if s.p4 != nil {
+		if err := s.p4.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+			rootLogger.Debug("Error enabling TTL reporting", "network", network, "err", err)
+		}
+	}
+	if s.p6 != nil {
+		if err := s.p6.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+			rootLogger.Debug("Error enabling hop limit reporting", "network", network, "err", err)
+		}
+	}
+	return s, nil
+}
+
+// destination returns the address to send requests to ip to, which for ping
+// sockets has to be a *net.UDPAddr.
+func (s *icmpSocket) destination(ip *net.IPAddr) net.Addr {
+	if s.network == "udp4" || s.network == "udp6" {
+		return &net.UDPAddr{IP: ip.IP, Zone: ip.Zone}
+	}
+	return ip
+}
+
+// socket returns the shared socket for network, listening on address and
+// bound to device if not empty, opening it on first use.
+func (l *icmpListener) socket(network, address, device string, dontFragment bool) (*icmpSocket, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sk := icmpSocketKey{network: network, address: address, device: device, dontFragment: dontFragment}
+	if s, ok := l.sockets[sk]; ok {
+		return s, nil
+	}
+	s, err := newICMPSocket(network, address, device, dontFragment)
+	if err != nil {
+		return nil, err
+	}
+	l.sockets[sk] = s
+	go l.read(sk, s)
+	return s, nil
+}
+
+// register allocates a sequence number for a request to peer and returns the
+// channel its reply will be delivered on.  The caller must unregister the key
+// once done with it.
+func (l *icmpListener) register(s *icmpSocket, peer net.IP) (icmpKey, <-chan icmpReply, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := icmpKey{network: s.network, proto: s.proto, id: s.id, peer: peer.String()}
+	// icmpSequence wraps around after 65536 requests, so skip over sequence
+	// numbers still in use by an outstanding request to the same peer.
+	for i := 0; i <= 0xffff; i++ {
+		key.seq = int(getICMPSequence())
+		if _, ok := l.waiters[key]; !ok {
+			replies := make(chan icmpReply, 1)
+			l.waiters[key] = replies
+			return key, replies, nil
+		}
+	}
+	return key, nil, errors.New("no free ICMP sequence number")
+}
+
+// registerKey registers a request identified by key, for requests not sent
+// as echo requests over the shared socket.
+func (l *icmpListener) registerKey(key icmpKey) (<-chan icmpReply, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.waiters[key]; ok {
+		return nil, errors.New("request already outstanding")
+	}
+	replies := make(chan icmpReply, 1)
+	l.waiters[key] = replies
+	return replies, nil
+}
+
+func (l *icmpListener) unregister(key icmpKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.waiters, key)
+}
+
+// dispatch delivers a reply to the probe waiting for key, if any.
+func (l *icmpListener) dispatch(key icmpKey, reply icmpReply) {
+	l.mu.Lock()
+	replies, ok := l.waiters[key]
+	l.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case replies <- reply:
+	default:
+		// A reply was already delivered, e.g. a duplicate.
+	}
+}
+
+// readFrom reads an ICMP message from the socket along with the TTL or hop
+// limit it arrived with.
+func (s *icmpSocket) readFrom(b []byte) (n int, hopLimit int, peer net.Addr, err error) {
+	hopLimit = -1
+	if s.p4 != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, peer, err = s.p4.ReadFrom(b)
+		if cm != nil {
+			hopLimit = cm.TTL
+		}
+		return
+	}
+	var cm *ipv6.ControlMessage
+	n, cm, peer, err = s.p6.ReadFrom(b)
+	if cm != nil {
+		hopLimit = cm.HopLimit
+	}
+	return
+}
+
+// quotedKey extracts the protocol, destination and the echo ID and sequence
+// number or ports of the packet quoted in the original datagram field of an
+// ICMP error message.
+func quotedKey(proto int, data []byte) (key icmpKey, ok bool) {
+	var headerLen int
+	var dst net.IP
+	switch proto {
+	case protocolICMP:
+		if len(data) < ipv4.HeaderLen {
+			return
+		}
+		headerLen = int(data[0]&0x0f) << 2
+		key.proto = int(data[9])
+		dst = net.IP(data[16:20])
+	case protocolIPv6ICMP:
+		if len(data) < ipv6.HeaderLen {
+			return
+		}
+		headerLen = ipv6.HeaderLen
+		key.proto = int(data[6])
+		dst = net.IP(data[24:40])
+	default:
+		return
+	}
+	// Only the first 8 bytes of the quoted packet are guaranteed.
+	if len(data) < headerLen+8 {
+		return
+	}
+	quoted := data[headerLen:]
+	switch key.proto {
+	case protocolICMP:
+		if quoted[0] != byte(ipv4.ICMPTypeEcho) {
+			return
+		}
+		key.id = int(quoted[4])<<8 | int(quoted[5])
+		key.seq = int(quoted[6])<<8 | int(quoted[7])
+	case protocolIPv6ICMP:
+		if quoted[0] != byte(ipv6.ICMPTypeEchoRequest) {
+			return
+		}
+		key.id = int(quoted[4])<<8 | int(quoted[5])
+		key.seq = int(quoted[6])<<8 | int(quoted[7])
+	case protocolTCP, protocolUDP:
+		key.id = int(quoted[0])<<8 | int(quoted[1])
+		key.seq = int(quoted[2])<<8 | int(quoted[3])
+	default:
+		return
+	}
+	key.peer = dst.String()
+	return key, true
+}
+
+func (l *icmpListener) read(sk icmpSocketKey, s *icmpSocket) {
+	// Large enough for the biggest possible reply, so that replies to large
+	// payloads aren't truncated.
+	rb := make([]byte, 65536)
+	for {
+		n, hopLimit, peer, err := s.readFrom(rb)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			rootLogger.Error("Error reading from socket, closing it", "network", s.network, "err", err)
+			l.mu.Lock()
+			delete(l.sockets, sk)
+			l.mu.Unlock()
+			s.conn.Close()
+			return
+		}
+		l.receive(s, rb[:n], hopLimit, peer)
+	}
+}
+
+// receive parses a message read from the socket and dispatches it to the
+// probe waiting for it, if it is an echo reply or an error quoting a request.
+func (l *icmpListener) receive(s *icmpSocket, b []byte, hopLimit int, peer net.Addr) {
+	reply := icmpReply{peer: peerIP(peer), hopLimit: hopLimit, received: time.Now()}
+	var err error
+	reply.message, err = icmp.ParseMessage(s.proto, b)
+	if err != nil {
+		rootLogger.Debug("Error parsing ICMP message", "peer", reply.peer, "err", err)
+		return
+	}
+	key := icmpKey{network: s.network}
+	var quoted []byte
+	switch body := reply.message.Body.(type) {
+	case *icmp.Echo:
+		if reply.message.Type != ipv4.ICMPTypeEchoReply && reply.message.Type != ipv6.ICMPTypeEchoReply {
+			return
+		}
+		key.proto, key.id, key.seq, key.peer = s.proto, body.ID, body.Seq, reply.peer.String()
+	case *icmp.DstUnreach:
+		quoted = body.Data
+	case *icmp.TimeExceeded:
+		quoted = body.Data
+	case *icmp.PacketTooBig:
+		quoted = body.Data
+	case *icmp.ParamProb:
+		quoted = body.Data
+	default:
+		return
+	}
+	if quoted != nil {
+		var ok bool
+		if key, ok = quotedKey(s.proto, quoted); !ok {
+			return
+		}
+		key.network = s.network
+	}
+	l.dispatch(key, reply)
+}
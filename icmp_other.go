@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setDontFragment(c syscall.RawConn, ip6 bool) error {
+	return errors.New("don't fragment is only supported on Linux")
+}
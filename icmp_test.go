@@ -0,0 +1,295 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeICMPConn stands in for the connection of a shared ICMP socket.  Echo
+// requests written to it are answered by respond, whose reply is passed to
+// the listener as if it had been read from the socket.
+type fakeICMPConn struct {
+	net.PacketConn
+	socket  *icmpSocket
+	respond func(request []byte, echo *icmp.Echo, dst net.IP) (reply *icmp.Message, peer net.IP)
+}
+
+func (c *fakeICMPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	m, err := icmp.ParseMessage(protocolICMP, b)
+	if err != nil {
+		return 0, err
+	}
+	reply, peer := c.respond(b, m.Body.(*icmp.Echo), addr.(*net.IPAddr).IP)
+	if reply != nil {
+		wb, err := reply.Marshal(nil)
+		if err != nil {
+			return 0, err
+		}
+		icmpListenerInstance.receive(c.socket, wb, 64, &net.IPAddr{IP: peer})
+	}
+	return len(b), nil
+}
+
+// fakeICMPModule returns a module whose ICMP probes use a fake socket in the
+// shared listener, answered by respond.  The module binds to a device named
+// after the test, so that it doesn't share the socket with other tests.
+func fakeICMPModule(t *testing.T, config ICMPProbe, respond func([]byte, *icmp.Echo, net.IP) (*icmp.Message, net.IP)) Module {
+	socket := &icmpSocket{network: "ip4:icmp", proto: protocolICMP, id: 4321}
+	socket.conn = &fakeICMPConn{socket: socket, respond: respond}
+	sk := icmpSocketKey{network: "ip4:icmp", address: "0.0.0.0", device: t.Name(), dontFragment: config.DontFragment || config.DiscoverPathMTU}
+	icmpListenerInstance.mu.Lock()
+	icmpListenerInstance.sockets[sk] = socket
+	icmpListenerInstance.mu.Unlock()
+	t.Cleanup(func() {
+		icmpListenerInstance.mu.Lock()
+		delete(icmpListenerInstance.sockets, sk)
+		icmpListenerInstance.mu.Unlock()
+	})
+	return Module{Timeout: 5 * time.Second, BindToDevice: t.Name(), ICMP: config}
+}
+
+// icmpErrorMessage returns an ICMP error of the given type, as sent by a
+// router, quoting the IP header and first 8 bytes of a request to dst.
+func icmpErrorMessage(t *testing.T, typ ipv4.ICMPType, code int, request []byte, dst net.IP) *icmp.Message {
+	header, err := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(request),
+		TTL:      1,
+		Protocol: protocolICMP,
+		Src:      net.ParseIP("192.0.2.1"),
+		Dst:      dst,
+	}).Marshal()
+	if err != nil {
+		t.Fatalf("Error marshalling IP header: %s", err)
+	}
+	data := append(header, request[:8]...)
+	m := &icmp.Message{Type: typ, Code: code}
+	switch typ {
+	case ipv4.ICMPTypeTimeExceeded:
+		m.Body = &icmp.TimeExceeded{Data: data}
+	default:
+		m.Body = &icmp.DstUnreach{Data: data}
+	}
+	return m
+}
+
+func TestICMPSequenceWraparound(t *testing.T) {
+	listener := &icmpListener{
+		sockets: map[icmpSocketKey]*icmpSocket{},
+		waiters: map[icmpKey]chan icmpReply{},
+	}
+	socket := &icmpSocket{network: "ip4:icmp", id: 1}
+	peer := net.ParseIP("192.0.2.1")
+
+	icmpSequenceMutex.Lock()
+	icmpSequence = 0xfffe
+	icmpSequenceMutex.Unlock()
+	first, _, err := listener.register(socket, peer)
+	if err != nil {
+		t.Fatalf("Error registering request: %s", err)
+	}
+	defer listener.unregister(first)
+	if first.seq != 0xffff {
+		t.Fatalf("Unexpected sequence number: got %d, want %d", first.seq, 0xffff)
+	}
+
+	// Wrap around so that the next sequence number is still outstanding.
+	icmpSequenceMutex.Lock()
+	icmpSequence = 0xfffe
+	icmpSequenceMutex.Unlock()
+	second, _, err := listener.register(socket, peer)
+	if err != nil {
+		t.Fatalf("Error registering request: %s", err)
+	}
+	defer listener.unregister(second)
+	if second.seq != 0 {
+		t.Fatalf("Unexpected sequence number: got %d, want %d", second.seq, 0)
+	}
+}
+
+func TestICMPConcurrentProbes(t *testing.T) {
+	module := Module{Timeout: time.Second}
+	if _, err := icmpListenerInstance.socket("ip4:icmp", "0.0.0.0", "", false); err != nil {
+		t.Skipf("Cannot open ICMP socket: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			metrics := NewMetricSink()
+			defer close(metrics)
+			if success, _ := probeICMP("127.0.0.1", module, metrics); !success {
+				t.Errorf("ICMP module failed, expected success.")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestICMPQuotedKey(t *testing.T) {
+	echo, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho, Code: 0,
+		Body: &icmp.Echo{ID: 1234, Seq: 5678, Data: []byte("Prometheus Blackbox Exporter")},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("Error marshalling echo request: %s", err)
+	}
+	wb, err := icmpErrorMessage(t, ipv4.ICMPTypeTimeExceeded, 0, echo, net.ParseIP("198.51.100.1")).Marshal(nil)
+	if err != nil {
+		t.Fatalf("Error marshalling time exceeded message: %s", err)
+	}
+
+	rm, err := icmp.ParseMessage(protocolICMP, wb)
+	if err != nil {
+		t.Fatalf("Error parsing time exceeded message: %s", err)
+	}
+	key, ok := quotedKey(protocolICMP, rm.Body.(*icmp.TimeExceeded).Data)
+	if !ok {
+		t.Fatalf("Quoted echo request not found.")
+	}
+	if want := (icmpKey{proto: protocolICMP, id: 1234, seq: 5678, peer: "198.51.100.1"}); key != want {
+		t.Fatalf("Unexpected quoted echo request: got %+v, want %+v", key, want)
+	}
+}
+
+func TestICMPErrorReplyFailsFast(t *testing.T) {
+	for _, test := range []struct {
+		typ  ipv4.ICMPType
+		code int
+	}{
+		{ipv4.ICMPTypeDestinationUnreachable, 1},
+		{ipv4.ICMPTypeTimeExceeded, 0},
+	} {
+		t.Run(test.typ.String(), func(t *testing.T) {
+			router := net.ParseIP("198.51.100.1")
+			module := fakeICMPModule(t, ICMPProbe{}, func(request []byte, _ *icmp.Echo, dst net.IP) (*icmp.Message, net.IP) {
+				return icmpErrorMessage(t, test.typ, test.code, request, dst), router
+			})
+			metrics := make(chan Metric, 10)
+			start := time.Now()
+			success, reason := probeICMP("192.0.2.1", module, metrics)
+			if success || reason != failureUnreachable {
+				t.Fatalf("ICMP module returned %v with reason %q, expected an unreachable failure.", success, reason)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("ICMP module took %s to fail, expected it to fail on the error reply.", elapsed)
+			}
+			close(metrics)
+			for m := range metrics {
+				if m.Name == "probe_icmp_reply_type" && m.FloatValue != float64(test.typ) {
+					t.Fatalf("Unexpected reply type: got %v, want %d", m.FloatValue, test.typ)
+				}
+			}
+		})
+	}
+}
+
+func TestICMPUnprivileged(t *testing.T) {
+	socket, err := icmpListenerInstance.socket("udp4", "0.0.0.0", "", false)
+	if err != nil {
+		t.Skipf("Cannot open ping socket, check net.ipv4.ping_group_range: %s", err)
+	}
+	// The kernel rewrites the echo ID to the local port of ping sockets, so
+	// replies are only matched if the socket uses it as its ID.
+	if port := socket.conn.LocalAddr().(*net.UDPAddr).Port; socket.id != port {
+		t.Fatalf("Unexpected echo ID for ping socket: got %d, want local port %d", socket.id, port)
+	}
+
+	module := Module{Timeout: time.Second, ICMP: ICMPProbe{Unprivileged: true}}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, reason := probeICMP("127.0.0.1", module, metrics); !success {
+		t.Fatalf("Unprivileged ICMP module failed with reason %q, expected success.", reason)
+	}
+}
+
+func TestICMPLargePayload(t *testing.T) {
+	module := Module{Timeout: time.Second, ICMP: ICMPProbe{PayloadSize: 8000}}
+	if _, err := icmpListenerInstance.socket("ip4:icmp", "0.0.0.0", "", false); err != nil {
+		t.Skipf("Cannot open ICMP socket: %s", err)
+	}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, reason := probeICMP("127.0.0.1", module, metrics); !success {
+		t.Fatalf("ICMP module failed with a large payload with reason %q, expected success.", reason)
+	}
+
+	module.ICMP.PayloadSize = 65535
+	if success, reason := probeICMP("127.0.0.1", module, metrics); success || reason != failureConfig {
+		t.Fatalf("ICMP module with an oversized payload returned %v with reason %q, expected a config failure.", success, reason)
+	}
+}
+
+// fakePathMTU returns a responder for a path with the given MTU, on which a
+// router reports larger packets as needing fragmentation.
+func fakePathMTU(t *testing.T, mtu int) func([]byte, *icmp.Echo, net.IP) (*icmp.Message, net.IP) {
+	return func(request []byte, echo *icmp.Echo, dst net.IP) (*icmp.Message, net.IP) {
+		if ipv4.HeaderLen+len(request) > mtu {
+			return icmpErrorMessage(t, ipv4.ICMPTypeDestinationUnreachable, 4, request, dst), net.ParseIP("198.51.100.1")
+		}
+		return &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: echo}, dst
+	}
+}
+
+func TestICMPPathMTU(t *testing.T) {
+	module := fakeICMPModule(t, ICMPProbe{DiscoverPathMTU: true}, fakePathMTU(t, 1400))
+	metrics := make(chan Metric, 10)
+	if success, reason := probeICMP("192.0.2.1", module, metrics); !success {
+		t.Fatalf("ICMP module failed with reason %q, expected success.", reason)
+	}
+	close(metrics)
+	if m := <-metrics; m.Name != "probe_icmp_path_mtu_bytes" || m.FloatValue != 1400 {
+		t.Fatalf("Unexpected path MTU: %v", m)
+	}
+}
+
+func TestICMPDontFragment(t *testing.T) {
+	module := fakeICMPModule(t, ICMPProbe{DontFragment: true, PayloadSize: 1372}, fakePathMTU(t, 1400))
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, reason := probeICMP("192.0.2.1", module, metrics); !success {
+		t.Fatalf("ICMP module failed with reason %q, expected success.", reason)
+	}
+
+	module.ICMP.PayloadSize = 1373
+	if success, reason := probeICMP("192.0.2.1", module, metrics); success || reason != failureUnreachable {
+		t.Fatalf("ICMP module returned %v with reason %q for a payload exceeding the MTU, expected an unreachable failure.", success, reason)
+	}
+}
+
+func TestICMPPathMTULoopback(t *testing.T) {
+	if _, err := icmpListenerInstance.socket("ip4:icmp", "0.0.0.0", "", true); err != nil {
+		t.Skipf("Cannot open ICMP socket: %s", err)
+	}
+	// The loopback MTU is larger than any payload tried, so the largest one
+	// is reported.
+	module := Module{Timeout: time.Second, ICMP: ICMPProbe{DiscoverPathMTU: true, PayloadSize: 8000}}
+	metrics := make(chan Metric, 10)
+	if success, reason := probeICMP("127.0.0.1", module, metrics); !success {
+		t.Fatalf("ICMP module failed with reason %q, expected success.", reason)
+	}
+	close(metrics)
+	if m := <-metrics; m.Name != "probe_icmp_path_mtu_bytes" || m.FloatValue != ipv4.HeaderLen+8+8000 {
+		t.Fatalf("Unexpected path MTU: %v", m)
+	}
+}
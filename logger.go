@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	logLevel  = flag.String("log.level", "info", "Only log messages with the given severity or above. One of: debug, info, warn, error.")
+	logFormat = flag.String("log.format", "logfmt", "Output format of log messages. One of: logfmt, json.")
+)
+
+// rootLogger is the exporter's logger, set up from the flags by main.
+var rootLogger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// probeIDs numbers probes, so that the lines each one logs can be told apart.
+var probeIDs uint64
+
+// newLogger returns a logger writing to w in the given format, which only
+// logs messages of the given level or above.
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+	options := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// probeLines keeps the lines logged by a probe.
+type probeLines struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (p *probeLines) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lines = append(p.lines, string(bytes.TrimSuffix(b, []byte("\n"))))
+	return len(b), nil
+}
+
+func (p *probeLines) get() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.lines...)
+}
+
+// probeLogger logs on behalf of a single probe, with fields identifying the
+// probe, and keeps what it logged at any level so it can be shown alongside
+// the probe's results.  A nil *probeLogger logs to the root logger only.
+type probeLogger struct {
+	logger  *slog.Logger
+	capture *slog.Logger
+	lines   *probeLines
+	// The lines also logged by the root logger are kept apart, so that probe
+	// history doesn't show more than the exporter's own log.
+	captureLogged *slog.Logger
+	logged        *probeLines
+}
+
+// newProbeLogger returns a logger for a probe of a module.
+func newProbeLogger(moduleName string, module Module) *probeLogger {
+	lines, logged := &probeLines{}, &probeLines{}
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	l := &probeLogger{
+		logger:        rootLogger,
+		capture:       slog.New(slog.NewTextHandler(lines, options)),
+		lines:         lines,
+		captureLogged: slog.New(slog.NewTextHandler(logged, options)),
+		logged:        logged,
+	}
+	return l.with("probe_id", atomic.AddUint64(&probeIDs, 1), "module", moduleName, "prober", module.Prober)
+}
+
+// with returns a logger adding fields to every line, which keeps its lines
+// along with those of l.
+func (l *probeLogger) with(args ...interface{}) *probeLogger {
+	if l == nil {
+		return nil
+	}
+	return &probeLogger{
+		logger:        l.logger.With(args...),
+		capture:       l.capture.With(args...),
+		lines:         l.lines,
+		captureLogged: l.captureLogged.With(args...),
+		logged:        l.logged,
+	}
+}
+
+// log logs msg with args as key/value attributes, after the fields of l.
+func (l *probeLogger) log(level slog.Level, msg string, args ...interface{}) {
+	ctx := context.Background()
+	if l == nil {
+		rootLogger.Log(ctx, level, msg, args...)
+		return
+	}
+	if l.logger.Enabled(ctx, level) {
+		l.logger.Log(ctx, level, msg, args...)
+		l.captureLogged.Log(ctx, level, msg, args...)
+	}
+	l.capture.Log(ctx, level, msg, args...)
+}
+
+// Lines returns the lines logged so far, at any level.
+func (l *probeLogger) Lines() []string {
+	if l == nil {
+		return nil
+	}
+	return l.lines.get()
+}
+
+// LoggedLines returns the lines logged so far at the level of the root logger
+// or above.
+func (l *probeLogger) LoggedLines() []string {
+	if l == nil {
+		return nil
+	}
+	return l.logged.get()
+}
+
+func (l *probeLogger) Debug(msg string, args ...interface{}) {
+	l.log(slog.LevelDebug, msg, args...)
+}
+
+func (l *probeLogger) Info(msg string, args ...interface{}) {
+	l.log(slog.LevelInfo, msg, args...)
+}
+
+func (l *probeLogger) Warn(msg string, args ...interface{}) {
+	l.log(slog.LevelWarn, msg, args...)
+}
+
+func (l *probeLogger) Error(msg string, args ...interface{}) {
+	l.log(slog.LevelError, msg, args...)
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info", "json")
+	if err != nil {
+		t.Fatalf("Error creating logger: %s", err)
+	}
+	logger.Debug("hidden")
+	logger.Info("shown", "target", "example.com")
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Error parsing %q as a single JSON line: %s", buf.String(), err)
+	}
+	if line["msg"] != "shown" || line["level"] != "INFO" || line["target"] != "example.com" {
+		t.Fatalf("Unexpected line: %v", line)
+	}
+
+	buf.Reset()
+	if logger, err = newLogger(&buf, "debug", "logfmt"); err != nil {
+		t.Fatalf("Error creating logger: %s", err)
+	}
+	logger.Debug("shown", "target", "example.com")
+	if got := buf.String(); !strings.Contains(got, "level=DEBUG msg=shown target=example.com\n") {
+		t.Fatalf("Unexpected line: %q", got)
+	}
+
+	if _, err := newLogger(&buf, "verbose", "logfmt"); err == nil {
+		t.Fatalf("Expected an error for an unknown level")
+	}
+	if _, err := newLogger(&buf, "info", "xml"); err == nil {
+		t.Fatalf("Expected an error for an unknown format")
+	}
+}
+
+func TestProbeLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "warn", "logfmt")
+	if err != nil {
+		t.Fatalf("Error creating logger: %s", err)
+	}
+	defer func(l *slog.Logger) { rootLogger = l }(rootLogger)
+	rootLogger = logger
+
+	l := newProbeLogger("tcp_connect", Module{Prober: "tcp"})
+	l.Debug("Sending", "data", "hello")
+	l.with("target", "example.com:80").Warn("Error dialing", "err", "connection refused")
+
+	// Only lines at the configured level are logged, but all are kept.
+	if got := buf.String(); strings.Count(got, "\n") != 1 || !strings.Contains(got, "level=WARN msg=\"Error dialing\" probe_id=") || !strings.Contains(got, " module=tcp_connect prober=tcp target=example.com:80 err=\"connection refused\"\n") {
+		t.Fatalf("Unexpected log output: %q", got)
+	}
+	lines := l.Lines()
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", lines)
+	}
+	if !strings.Contains(lines[0], "level=DEBUG msg=Sending ") || !strings.HasSuffix(lines[0], " data=hello") || strings.Contains(lines[0], "target=") {
+		t.Fatalf("Unexpected first line: %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "level=WARN") || !strings.HasSuffix(lines[1], "target=example.com:80 err=\"connection refused\"") {
+		t.Fatalf("Unexpected second line: %q", lines[1])
+	}
+	// Only those logged are kept for the probe history.
+	if logged := l.LoggedLines(); len(logged) != 1 || logged[0] != lines[1] {
+		t.Fatalf("Expected only the second line to be logged, got %q", logged)
+	}
+
+	// A nil logger only logs.
+	var nilLogger *probeLogger
+	nilLogger.Error("Error in module")
+	if nilLogger.Lines() != nil || nilLogger.LoggedLines() != nil {
+		t.Fatalf("Expected no lines for a nil logger")
+	}
+}
@@ -3,62 +3,144 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/log"
 )
 
 var (
-	addr       = flag.String("web.listen-address", ":9115", "The address to listen on for HTTP requests.")
-	configFile = flag.String("config.file", "blackbox.yml", "Blackbox exporter configuration file.")
+	addr         = flag.String("web.listen-address", ":9115", "The address to listen on for HTTP requests.")
+	configFile   = flag.String("config.file", "blackbox.yml", "Blackbox exporter configuration file.")
+	historyLimit = flag.Int("history.limit", 100, "The maximum number of recent probes to show on the status page.")
 )
 
+// Version and Revision are set at build time.
 var (
-	probeLatencies = prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
-			Name: "probe_latency_summary_millis",
-			Help: "Latency of probes by type",
+	Version  = "unknown"
+	Revision = "unknown"
+)
+
+var (
+	probeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "blackbox_exporter_probe_duration_seconds",
+			Help:    "Duration of probes by module, prober and result.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
 		},
-		[]string{"module", "success"},
+		[]string{"module", "prober", "success"},
 	)
-	probeHistogram = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "probe_latency_histogram_millis",
-			Help:    "Latency of probes by type",
-			Buckets: prometheus.ExponentialBuckets(1, 2, 20),
+	probesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "blackbox_exporter_probes_total",
+			Help: "Total number of probes by module, prober and result.",
 		},
-		[]string{"module", "success"},
+		[]string{"module", "prober", "success"},
 	)
-	probeCounter = prometheus.NewCounterVec(
+	probeFailuresTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "probe_count",
-			Help: "Latency of probes by type",
+			Name: "blackbox_exporter_probe_failures_total",
+			Help: "Total number of failed probes by module, prober and reason.",
 		},
-		[]string{"module", "success"},
+		[]string{"module", "prober", "reason"},
+	)
+	probesInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "blackbox_exporter_probes_in_flight",
+			Help: "Number of probes currently running.",
+		},
+	)
+	configLoadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "blackbox_exporter_config_last_load_successful",
+			Help: "Whether the last configuration load succeeded.",
+		},
+	)
+	configLoadTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "blackbox_exporter_config_last_load_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration load.",
+		},
+	)
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "blackbox_exporter_build_info",
+			Help: "A metric with a constant '1' value labelled by the version and revision the exporter was built from, and the Go version it was built with.",
+		},
+		[]string{"version", "revision", "goversion"},
 	)
 )
 
 func init() {
-	prometheus.MustRegister(probeLatencies)
-	prometheus.MustRegister(probeHistogram)
-	prometheus.MustRegister(probeCounter)
+	prometheus.MustRegister(probeDuration)
+	prometheus.MustRegister(probesTotal)
+	prometheus.MustRegister(probeFailuresTotal)
+	prometheus.MustRegister(probesInFlight)
+	prometheus.MustRegister(configLoadSuccess)
+	prometheus.MustRegister(configLoadTimestamp)
+	prometheus.MustRegister(buildInfo)
+	buildInfo.WithLabelValues(Version, Revision, runtime.Version()).Set(1)
 }
 
 type Config struct {
 	Modules map[string]Module `yaml:"modules"`
 }
 
+// secret is a config value that may carry credentials, such as a request
+// header, which is hidden when the config is shown.
+type secret string
+
+// MarshalYAML hides the value, e.g. from the module configuration returned
+// with debug=true.
+func (s secret) MarshalYAML() (interface{}, error) {
+	return "<secret>", nil
+}
+
 type Module struct {
 	Prober  string        `yaml:"prober"`
 	Timeout time.Duration `yaml:"timeout"`
-	HTTP    HTTPProbe     `yaml:"http"`
-	TCP     TCPProbe      `yaml:"tcp"`
-	ICMP    ICMPProbe     `yaml:"icmp"`
+	// Address to send probes from, and network interface to send them over,
+	// e.g. to probe over a particular uplink.
+	SourceIPAddress string `yaml:"source_ip_address"`
+	BindToDevice    string `yaml:"bind_to_device"`
+
+	HTTP       HTTPProbe       `yaml:"http"`
+	TCP        TCPProbe        `yaml:"tcp"`
+	UDP        UDPProbe        `yaml:"udp"`
+	GRPC       GRPCProbe       `yaml:"grpc"`
+	SMTP       SMTPProbe       `yaml:"smtp"`
+	SSH        SSHProbe        `yaml:"ssh"`
+	PostgreSQL DatabaseProbe   `yaml:"postgresql"`
+	MySQL      DatabaseProbe   `yaml:"mysql"`
+	Redis      DatabaseProbe   `yaml:"redis"`
+	WebSocket  WebSocketProbe  `yaml:"websocket"`
+	HTTPFlow   HTTPFlowProbe   `yaml:"http_flow"`
+	ICMP       ICMPProbe       `yaml:"icmp"`
+	Traceroute TracerouteProbe `yaml:"traceroute"`
+
+	// Probe every address each target resolves to, rather than just one.
+	ProbeAllAddresses bool `yaml:"probe_all_addresses"`
+
+	// name is the name the module is configured under.
+	name string
+	// address is the address host is probed at, if pinned to one of the
+	// addresses it resolves to.
+	host    string
+	address string
+	// logger keeps the log lines of a single probe.
+	logger *probeLogger
 }
 
 type HTTPProbe struct {
@@ -71,115 +153,423 @@ type HTTPProbe struct {
 	FailIfMatchesRegexp    []string `yaml:"fail_if_matches_regexp"`
 	FailIfNotMatchesRegexp []string `yaml:"fail_if_not_matches_regexp"`
 	Path                   string   `yaml:"path"`
+	// Request headers, also used by the websocket prober along with the TLS
+	// settings.
+	Headers            map[string]secret `yaml:"headers"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+	// Keep cookies set by responses for the requests that follow, e.g. when
+	// following redirects through a login handshake.
+	CookieJar bool `yaml:"cookie_jar"`
+	// Cookies to send with the first request.
+	Cookies map[string]secret `yaml:"cookies"`
+	// Either new, to make each probe over a new connection, or persistent, to
+	// reuse connections kept alive from earlier probes of the module.
+	// Defaults to new.
+	ConnectionMode string `yaml:"connection_mode"`
+	// Named capture groups of fail_if_not_matches_regexp to export as metric
+	// values, all others are exported as labels.
+	CaptureValues []string `yaml:"capture_values"`
+}
+
+type HTTPFlowProbe struct {
+	// Steps are run in order, sharing a cookie jar as well as the headers,
+	// static cookies and TLS settings of the http section.
+	Steps []HTTPFlowStep `yaml:"steps"`
+}
+
+type HTTPFlowStep struct {
+	// Defaults to the index of the step.
+	Name string `yaml:"name"`
+	// Defaults to GET.
+	Method string `yaml:"method"`
+	// Path, headers and body may refer to values extracted by earlier steps
+	// as ${name}.
+	Path    string            `yaml:"path"`
+	Headers map[string]secret `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	// Defaults to 2xx.
+	ValidStatusCodes []int             `yaml:"valid_status_codes"`
+	Extract          []HTTPFlowExtract `yaml:"extract"`
+}
+
+// HTTPFlowExtract extracts a value from the response body, by either the
+// first capture group of a regexp or a JSON path such as $.items[0].id.
+type HTTPFlowExtract struct {
+	Name     string `yaml:"name"`
+	Regexp   string `yaml:"regexp"`
+	JSONPath string `yaml:"json_path"`
+	// re is Regexp compiled when the config is loaded.
+	re *regexp.Regexp
 }
 
 type QueryResponse struct {
 	Expect string `yaml:"expect"`
-	Send   string `yaml:"send"`
+	// Bytes the response must contain, hex encoded.
+	ExpectHex string `yaml:"expect_hex"`
+	// Responses are read up to the delimiter, which defaults to a newline,
+	// unless a fixed number of bytes to read is given.
+	Delimiter string `yaml:"delimiter"`
+	ReadBytes int    `yaml:"read_bytes"`
+	Send      string `yaml:"send"`
+	// Bytes to send as is after send, hex encoded.
+	SendHex           string `yaml:"send_hex"`
+	NoTrailingNewline bool   `yaml:"no_trailing_newline"`
+	// Upgrade the connection to TLS after expect and send.
+	StartTLS bool `yaml:"starttls"`
 }
 
 type TCPProbe struct {
-	QueryResponse []QueryResponse `yaml:"query_response"`
+	QueryResponse      []QueryResponse `yaml:"query_response"`
+	InsecureSkipVerify bool            `yaml:"insecure_skip_verify"`
+	// Named capture groups of expect to export as metric values, all others
+	// are exported as labels.
+	CaptureValues []string `yaml:"capture_values"`
+}
+
+type UDPProbe struct {
+	// The datagram sent is send followed by the bytes of send_hex.
+	Send      string `yaml:"send"`
+	SendHex   string `yaml:"send_hex"`
+	Expect    string `yaml:"expect"`
+	ExpectHex string `yaml:"expect_hex"`
+	// Number of times to resend the datagram if no matching reply arrives.
+	Retries int `yaml:"retries"`
+	// Named capture groups of expect to export as metric values, all others
+	// are exported as labels.
+	CaptureValues []string `yaml:"capture_values"`
+}
+
+type GRPCProbe struct {
+	// Service to check the health of, defaults to the server as a whole.
+	Service            string `yaml:"service"`
+	TLS                bool   `yaml:"tls"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// Metadata to send along with the health check, e.g. for authentication.
+	Metadata map[string]secret `yaml:"metadata"`
+}
+
+type SMTPProbe struct {
+	// Hostname to send in EHLO, defaults to localhost.
+	Hostname           string `yaml:"hostname"`
+	StartTLS           bool   `yaml:"starttls"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// Authenticate with AUTH PLAIN if a username is given, which requires
+	// STARTTLS unless insecure_auth is set.
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file"`
+	InsecureAuth bool   `yaml:"insecure_auth"`
+	// Run MAIL FROM, and RCPT TO if given, if a sender is given.
+	MailFrom string `yaml:"mail_from"`
+	RcptTo   string `yaml:"rcpt_to"`
+	// Reply codes expected for the banner, ehlo, starttls, auth, mail and
+	// rcpt commands, where a single digit matches any code starting with it.
+	ExpectCodes map[string]int `yaml:"expect_codes"`
+}
+
+type SSHProbe struct {
+	// Fail unless the host key matches one of these fingerprints, in the
+	// SHA256:... or the legacy MD5 format.
+	HostKeyFingerprints []string `yaml:"host_key_fingerprints"`
+	// Host key algorithms to accept, in order of preference, e.g. to select
+	// the key to check the fingerprint of.
+	HostKeyAlgorithms []string `yaml:"host_key_algorithms"`
+}
+
+type DatabaseProbe struct {
+	Username string `yaml:"username"`
+	// File to read the password from, so that it needn't be in the config.
+	PasswordFile string `yaml:"password_file"`
+	// Database name, or for Redis the database number.
+	Database           string `yaml:"database"`
+	TLS                bool   `yaml:"tls"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// Query to run, defaults to SELECT 1, or for Redis the command to run,
+	// which defaults to PING.
+	Query string `yaml:"query"`
+}
+
+type WebSocketProbe struct {
+	// Message to send once connected, if any.
+	Send string `yaml:"send"`
+	// Wait for a message matching this regexp, if given.
+	Expect string `yaml:"expect"`
 }
 
 type ICMPProbe struct {
+	// Defaults to ip4.
+	Protocol     string `yaml:"protocol"`
+	Unprivileged bool   `yaml:"unprivileged"`
+	// Defaults to 28 bytes, or the largest payload fitting a 1500 byte MTU
+	// when discovering the path MTU.
+	PayloadSize     int  `yaml:"payload_size"`
+	DontFragment    bool `yaml:"dont_fragment"`
+	DiscoverPathMTU bool `yaml:"discover_path_mtu"`
+}
+
+type TracerouteProbe struct {
+	// One of icmp, udp or tcp, defaults to icmp.
+	Method string `yaml:"method"`
+	// Defaults to ip4.
+	Protocol string `yaml:"protocol"`
+	// Defaults to 30.
+	MaxHops int `yaml:"max_hops"`
+	// Defaults to the module timeout divided by max_hops.
+	HopTimeout time.Duration `yaml:"hop_timeout"`
+	// Destination port, defaults to 33434 (incremented per hop) for udp and
+	// 80 for tcp.
+	Port int `yaml:"port"`
 }
 
 type Metric struct {
 	Name       string
 	FloatValue float64
+	Labels     map[string]string
 }
 
-var Probers = map[string]func(string, Module, chan<- Metric) bool{
-	"http": probeHTTP,
-	"tcp":  probeTCP,
-	"icmp": probeICMP,
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// String formats the metric as a line of the Prometheus text format.
+func (m Metric) String() string {
+	if len(m.Labels) == 0 {
+		return fmt.Sprintf("%s %f", m.Name, m.FloatValue)
+	}
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(m.Labels[name])))
+	}
+	return fmt.Sprintf("%s{%s} %f", m.Name, strings.Join(pairs, ","), m.FloatValue)
+}
+
+var Probers = map[string]func(string, Module, chan<- Metric) (bool, failureReason){
+	"http":       probeHTTP,
+	"tcp":        probeTCP,
+	"udp":        probeUDP,
+	"grpc":       probeGRPC,
+	"smtp":       probeSMTP,
+	"ssh":        probeSSH,
+	"postgresql": probePostgreSQL,
+	"mysql":      probeMySQL,
+	"redis":      probeRedis,
+	"websocket":  probeWebSocket,
+	"http_flow":  probeHTTPFlow,
+	"icmp":       probeICMP,
+	"traceroute": probeTraceroute,
 }
 
-func probeHandler(w http.ResponseWriter, r *http.Request, config *Config) {
+// writeProbeDebug writes the lines a probe logged, the metrics it would have
+// returned and the configuration of the module it ran with.
+func writeProbeDebug(w io.Writer, module Module, metrics []Metric) {
+	fmt.Fprintln(w, "Logs for the probe:")
+	for _, line := range module.logger.Lines() {
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, "\nMetrics that would have been returned:")
+	for _, metric := range metrics {
+		fmt.Fprintln(w, metric)
+	}
+	fmt.Fprintf(w, "\nModule configuration for %s:\n", module.name)
+	config, err := yaml.Marshal(module)
+	if err != nil {
+		fmt.Fprintf(w, "Error marshalling module: %s\n", err)
+		return
+	}
+	w.Write(config)
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request, config *Config, history *probeHistory) {
 	params := r.URL.Query()
-	target := params.Get("target")
+	targets := params["target"]
 	moduleName := params.Get("module")
-	if target == "" {
+	if len(targets) == 0 || targets[0] == "" {
 		http.Error(w, "Target parameter is missing", 400)
 		return
 	}
 	if moduleName == "" {
-		moduleName = "http2xx"
+		moduleName = "http_2xx"
 	}
 	module, ok := config.Modules[moduleName]
 	if !ok {
 		http.Error(w, fmt.Sprintf("Unkown module %s", moduleName), 400)
 		return
 	}
+	module.name = moduleName
 	prober, ok := Probers[module.Prober]
 	if !ok {
 		http.Error(w, fmt.Sprintf("Unkown prober %s", module.Prober), 400)
 		return
 	}
+	module.logger = newProbeLogger(moduleName, module)
+	if len(targets) == 1 {
+		module.logger = module.logger.with("target", targets[0])
+	}
 
-	// Warning: magic number here.  This must be big enough to collect all the metrics.
-	metrics := make(chan Metric, 30)
+	// Collect metrics while the prober runs, as some probers emit a metric
+	// per hop or step.
+	metrics := make(chan Metric)
+	collected := make(chan []Metric)
+	go func() {
+		var all []Metric
+		for metric := range metrics {
+			all = append(all, metric)
+		}
+		collected <- all
+	}()
 
+	probesInFlight.Inc()
+	defer probesInFlight.Dec()
 	start := time.Now()
-	success := prober(target, module, metrics)
-	latency := float64(time.Now().Sub(start).Nanoseconds()) / 1e6
+	var success bool
+	var reason failureReason
+	if len(targets) == 1 && !module.ProbeAllAddresses {
+		success, reason = prober(targets[0], module, metrics)
+	} else {
+		// Each target and address reports its own duration and success,
+		// along with those of the probe as a whole below.
+		success, reason = probeTargets(prober, targets, module, metrics)
+	}
+	duration := time.Since(start)
+	history.add(probeHistoryEntry{
+		Module:   moduleName,
+		Targets:  targets,
+		Success:  success,
+		Start:    start,
+		Duration: duration,
+		Lines:    module.logger.LoggedLines(),
+	})
 
-	metrics <- Metric{"probe_duration_seconds", latency / 1e3}
+	metrics <- Metric{"probe_duration_seconds", duration.Seconds(), nil}
 	var successString string
 	if success {
-		metrics <- Metric{"probe_success", 1}
+		metrics <- Metric{"probe_success", 1, nil}
 		successString = "true"
 	} else {
-		metrics <- Metric{"probe_success", 0}
+		metrics <- Metric{"probe_success", 0, nil}
+		metrics <- Metric{"probe_failure_info", 1, map[string]string{"reason": string(reason)}}
 		successString = "false"
 	}
 
-	// Close the metric buffer and dump it.
+	// Close the metric channel and dump what was collected, or with
+	// debug=true everything there is to know about the probe.
 	close(metrics)
-	for metric := range metrics {
-		fmt.Fprintf(w, "%s %f\n", metric.Name, metric.FloatValue)
+	if params.Get("debug") == "true" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeProbeDebug(w, module, <-collected)
+	} else {
+		for _, metric := range <-collected {
+			fmt.Fprintln(w, metric)
+		}
 	}
 
-	probeLatencies.WithLabelValues(moduleName, successString).Observe(latency)
-	probeHistogram.WithLabelValues(moduleName, successString).Observe(latency)
-	probeCounter.WithLabelValues(moduleName, successString).Inc()
+	probeDuration.WithLabelValues(moduleName, module.Prober, successString).Observe(duration.Seconds())
+	probesTotal.WithLabelValues(moduleName, module.Prober, successString).Inc()
+	if !success {
+		probeFailuresTotal.WithLabelValues(moduleName, module.Prober, string(reason)).Inc()
+	}
 }
 
-func main() {
-	flag.Parse()
+// loadConfig reads and parses a configuration file, recording whether and
+// when it succeeded.
+func loadConfig(file string) (*Config, error) {
+	config := &Config{}
+	yamlFile, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = yaml.Unmarshal(yamlFile, config)
+	}
+	if err != nil {
+		configLoadSuccess.Set(0)
+		return nil, err
+	}
+	configLoadSuccess.Set(1)
+	configLoadTimestamp.Set(float64(time.Now().UnixNano()) / 1e9)
+	return config, nil
+}
 
-	yamlFile, err := ioutil.ReadFile(*configFile)
+// safeConfig holds the configuration, which may be reloaded while probes run.
+type safeConfig struct {
+	mu     sync.RWMutex
+	config *Config
+}
 
+func (c *safeConfig) get() *Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config
+}
+
+// reload loads the configuration file, keeping the current configuration if
+// that fails.
+func (c *safeConfig) reload(file string) error {
+	config, err := loadConfig(file)
 	if err != nil {
-		log.Fatalf("Error reading config file: %s", err)
+		rootLogger.Error("Error reloading config file", "file", file, "err", err)
+		return err
 	}
+	c.mu.Lock()
+	c.config = config
+	c.mu.Unlock()
+	rootLogger.Info("Configuration reloaded", "file", file)
+	return nil
+}
 
-	config := Config{}
+func reloadHandler(w http.ResponseWriter, r *http.Request, config *safeConfig, file string) {
+	if r.Method != "POST" {
+		http.Error(w, "This endpoint requires a POST request", 405)
+		return
+	}
+	if err := config.reload(file); err != nil {
+		http.Error(w, fmt.Sprintf("Error reloading config: %s", err), 500)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up logging: %s\n", err)
+		os.Exit(1)
+	}
+	rootLogger = logger
 
-	err = yaml.Unmarshal(yamlFile, &config)
+	config, err := loadConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Error parsing config file: %s", err)
+		rootLogger.Error("Error loading config file", "file", *configFile, "err", err)
+		os.Exit(1)
 	}
-	log.Infof("Configuration loaded from: %s", *configFile)
+	rootLogger.Info("Configuration loaded", "file", *configFile)
+	sc := &safeConfig{config: config}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			sc.reload(*configFile)
+		}
+	}()
 
 	http.Handle("/metrics", prometheus.Handler())
+	history := newProbeHistory(*historyLimit)
 	http.HandleFunc("/probe",
 		func(w http.ResponseWriter, r *http.Request) {
-			probeHandler(w, r, &config)
+			probeHandler(w, r, sc.get(), history)
 		})
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		reloadHandler(w, r, sc, *configFile)
+	})
+	http.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
+		logsHandler(w, r, history)
+	})
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-            <head><title>Blackbox Exporter</title></head>
-            <body>
-            <h1>Blackbox Exporter</h1>
-            <p><a href="/probe?target=prometheus.io&module=http_2xx">Probe prometheus.io for http_2xx</a></p>
-            <p><a href="/metrics">Metrics</a></p>
-            </body>
-            </html>`))
+		historyHandler(w, r, history)
 	})
-	log.Infof("Listening for connections on %s", *addr)
+	rootLogger.Info("Listening for connections", "address", *addr)
 	if err := http.ListenAndServe(*addr, nil); err != nil {
-		log.Fatalf("Error starting HTTP server: %s", err)
+		rootLogger.Error("Error starting HTTP server", "err", err)
+		os.Exit(1)
 	}
 }
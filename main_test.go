@@ -0,0 +1,265 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricString(t *testing.T) {
+	tests := []struct {
+		Metric Metric
+		Want   string
+	}{
+		{Metric{"probe_success", 1, nil}, "probe_success 1.000000"},
+		{
+			Metric{"probe_traceroute_hop_rtt_seconds", 0.5, map[string]string{"hop": "1", "address": "192.0.2.1"}},
+			`probe_traceroute_hop_rtt_seconds{address="192.0.2.1",hop="1"} 0.500000`,
+		},
+		{
+			Metric{"probe_info", 1, map[string]string{"banner": "a \"quoted\"\\\nbanner"}},
+			`probe_info{banner="a \"quoted\"\\\nbanner"} 1.000000`,
+		},
+	}
+	for i, test := range tests {
+		if got := test.Metric.String(); got != test.Want {
+			t.Fatalf("Test %d: got %q, want %q", i, got, test.Want)
+		}
+	}
+}
+
+func TestProbeDebug(t *testing.T) {
+	target := closedPort(t, "tcp")
+
+	config := &Config{Modules: map[string]Module{
+		"tcp_connect": {Prober: "tcp", Timeout: 3 * time.Second},
+	}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/probe?module=tcp_connect&debug=true&target="+target, nil)
+	probeHandler(w, r, config, newProbeHistory(10))
+
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Unexpected content type %q", got)
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		"Logs for the probe:\n",
+		"level=DEBUG msg=\"Error dialing\" probe_id=",
+		"module=tcp_connect prober=tcp target=" + target + " err=\"dial tcp " + target + ": ",
+		"\nMetrics that would have been returned:\n",
+		"\nprobe_success 0.000000\n",
+		"\nModule configuration for tcp_connect:\nprober: tcp\ntimeout: 3s\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in debug output:\n%s", expected, body)
+		}
+	}
+}
+
+func TestProbeDebugHidesSecrets(t *testing.T) {
+	target := closedPort(t, "tcp")
+
+	config := &Config{Modules: map[string]Module{
+		"tcp_connect": {
+			Prober:  "tcp",
+			Timeout: 3 * time.Second,
+			HTTP: HTTPProbe{
+				Headers: map[string]secret{"Authorization": "Bearer header-token"},
+				Cookies: map[string]secret{"session": "cookie-token"},
+			},
+			GRPC: GRPCProbe{Metadata: map[string]secret{"authorization": "Bearer metadata-token"}},
+			HTTPFlow: HTTPFlowProbe{Steps: []HTTPFlowStep{
+				{Headers: map[string]secret{"X-API-Key": "step-token"}},
+			}},
+		},
+	}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/probe?module=tcp_connect&debug=true&target="+target, nil)
+	probeHandler(w, r, config, newProbeHistory(10))
+
+	body := w.Body.String()
+	for _, value := range []string{"header-token", "cookie-token", "metadata-token", "step-token"} {
+		if strings.Contains(body, value) {
+			t.Errorf("Unexpected secret %q in debug output:\n%s", value, body)
+		}
+	}
+	if !strings.Contains(body, "Authorization: <secret>") {
+		t.Errorf("Expected hidden Authorization header in debug output:\n%s", body)
+	}
+}
+
+// selfMetrics returns the exporter's own metrics in the text format.
+func selfMetrics() string {
+	w := httptest.NewRecorder()
+	prometheus.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+// selfMetricValue returns the value of a sample in the text format, or 0 if
+// there is no such sample yet.
+func selfMetricValue(t *testing.T, metrics, sample string) float64 {
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, sample+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, sample+" "), 64)
+			if err != nil {
+				t.Fatalf("Error parsing %q: %s", line, err)
+			}
+			return value
+		}
+	}
+	return 0
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blackbox_exporter")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "blackbox.yml")
+	if err := ioutil.WriteFile(file, []byte("modules:\n  tcp_connect:\n    prober: tcp\n    timeout: 5s\n"), 0644); err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+
+	config, err := loadConfig(file)
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+	if module := config.Modules["tcp_connect"]; module.Prober != "tcp" || module.Timeout != 5*time.Second {
+		t.Fatalf("Unexpected module: %+v", module)
+	}
+	if metrics := selfMetrics(); !strings.Contains(metrics, "\nblackbox_exporter_config_last_load_success_timestamp_seconds 1.") {
+		t.Errorf("Expected a config load timestamp in:\n%s", metrics)
+	}
+
+	if metrics := selfMetrics(); selfMetricValue(t, metrics, "blackbox_exporter_config_last_load_successful") != 1 {
+		t.Errorf("Expected the config load to be successful in:\n%s", metrics)
+	}
+
+	if _, err := loadConfig(filepath.Join(dir, "missing.yml")); err == nil {
+		t.Fatalf("Expected an error loading a missing config file")
+	}
+	if metrics := selfMetrics(); selfMetricValue(t, metrics, "blackbox_exporter_config_last_load_successful") != 0 {
+		t.Errorf("Expected the config load to have failed in:\n%s", metrics)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blackbox_exporter")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "blackbox.yml")
+	if err := ioutil.WriteFile(file, []byte("modules:\n  tcp_connect:\n    prober: tcp\n"), 0644); err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+	config := &safeConfig{config: &Config{}}
+
+	w := httptest.NewRecorder()
+	reloadHandler(w, httptest.NewRequest("GET", "/-/reload", nil), config, file)
+	if w.Code != 405 || len(config.get().Modules) != 0 {
+		t.Fatalf("Expected a GET not to reload, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	reloadHandler(w, httptest.NewRequest("POST", "/-/reload", nil), config, file)
+	if w.Code != 200 {
+		t.Fatalf("Unexpected status reloading config: %d %s", w.Code, w.Body)
+	}
+	loaded := config.get()
+	if _, ok := loaded.Modules["tcp_connect"]; !ok {
+		t.Fatalf("Expected the reloaded config to have module tcp_connect: %+v", loaded)
+	}
+
+	// A broken config is reported and leaves the current one in place.
+	if err := ioutil.WriteFile(file, []byte("modules: [\n"), 0644); err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+	w = httptest.NewRecorder()
+	reloadHandler(w, httptest.NewRequest("POST", "/-/reload", nil), config, file)
+	if w.Code != 500 {
+		t.Fatalf("Expected an error reloading a broken config, got %d", w.Code)
+	}
+	if config.get() != loaded {
+		t.Fatalf("Expected the previous config to be kept")
+	}
+	if metrics := selfMetrics(); selfMetricValue(t, metrics, "blackbox_exporter_config_last_load_successful") != 0 {
+		t.Errorf("Expected the config load to have failed in:\n%s", metrics)
+	}
+}
+
+func TestSelfMetrics(t *testing.T) {
+	target := closedPort(t, "tcp")
+
+	config := &Config{Modules: map[string]Module{
+		"tcp_self_metrics": {Prober: "tcp", Timeout: time.Second},
+	}}
+	// The metrics are global, so only compare how they change with the probe.
+	samples := []string{
+		"blackbox_exporter_probes_total{module=\"tcp_self_metrics\",prober=\"tcp\",success=\"false\"}",
+		"blackbox_exporter_probe_failures_total{module=\"tcp_self_metrics\",prober=\"tcp\",reason=\"connect\"}",
+		"blackbox_exporter_probe_duration_seconds_count{module=\"tcp_self_metrics\",prober=\"tcp\",success=\"false\"}",
+	}
+	before := selfMetrics()
+	probeHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/probe?module=tcp_self_metrics&target="+target, nil), config, newProbeHistory(10))
+
+	metrics := selfMetrics()
+	for _, sample := range samples {
+		if delta := selfMetricValue(t, metrics, sample) - selfMetricValue(t, before, sample); delta != 1 {
+			t.Errorf("Expected %s to increase by 1, got %v in:\n%s", sample, delta, metrics)
+		}
+	}
+	for _, expected := range []string{
+		"\nblackbox_exporter_probes_in_flight 0\n",
+		"\nblackbox_exporter_build_info{goversion=",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("Expected %q in:\n%s", expected, metrics)
+		}
+	}
+}
+
+// closedPort returns a local address on network, tcp or udp, which nothing
+// listens on, so that connections to it are refused.
+func closedPort(t *testing.T, network string) string {
+	var (
+		l   io.Closer
+		err error
+	)
+	if network == "udp" {
+		l, err = net.ListenPacket(network, "127.0.0.1:0")
+	} else {
+		l, err = net.Listen(network, "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer l.Close()
+	if conn, ok := l.(net.PacketConn); ok {
+		return conn.LocalAddr().String()
+	}
+	return l.(net.Listener).Addr().String()
+}
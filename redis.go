@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// redisFailureReason classifies an error, returning reason if the server
+// replied with an error and otherwise fallback, unless it timed out.
+func redisFailureReason(err error, reason, fallback failureReason) failureReason {
+	if _, ok := err.(redis.Error); ok {
+		return reason
+	}
+	return errorFailureReason(err, fallback)
+}
+
+func probeRedis(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	config := module.Redis
+	if config.Query == "" {
+		config.Query = "PING"
+	}
+	command := strings.Fields(config.Query)
+	if len(command) == 0 {
+		module.logger.Error("Empty Redis query", "query", config.Query)
+		return false, failureConfig
+	}
+	password, err := readPassword(config.PasswordFile)
+	if err != nil {
+		module.logger.Error("Error reading password file", "err", err)
+		return false, failureConfig
+	}
+
+	dialer, err := newTimedDialer(module)
+	if err != nil {
+		module.logger.Error("Error in Redis module", "err", err)
+		return false, failureConfig
+	}
+	options := []redis.DialOption{
+		redis.DialContextFunc(dialer.DialContext),
+		redis.DialReadTimeout(module.Timeout),
+		redis.DialWriteTimeout(module.Timeout),
+		redis.DialUsername(config.Username),
+		redis.DialPassword(password),
+		redis.DialUseTLS(config.TLS),
+		redis.DialTLSSkipVerify(config.InsecureSkipVerify),
+	}
+	if config.Database != "" {
+		db, err := strconv.Atoi(config.Database)
+		if err != nil {
+			module.logger.Error("Invalid Redis database", "database", config.Database, "err", err)
+			return false, failureConfig
+		}
+		options = append(options, redis.DialDatabase(db))
+	}
+	// AUTH and SELECT are run as part of dialing.
+	openStart := time.Now()
+	conn, err := redis.DialContext(ctx, "tcp", target, options...)
+	if err != nil {
+		module.logger.Warn("Error connecting", "err", err)
+		return false, redisFailureReason(err, failureAuth, failureConnect)
+	}
+	defer conn.Close()
+	openDuration := time.Since(openStart)
+	metrics <- Metric{"probe_redis_connect_duration_seconds", dialer.duration.Seconds(), nil}
+	metrics <- Metric{"probe_redis_auth_duration_seconds", (openDuration - dialer.duration).Seconds(), nil}
+
+	args := make([]interface{}, len(command)-1)
+	for i, arg := range command[1:] {
+		args[i] = arg
+	}
+	queryStart := time.Now()
+	if _, err := conn.Do(command[0], args...); err != nil {
+		module.logger.Warn("Error running query", "query", config.Query, "err", err)
+		return false, redisFailureReason(err, failureQuery, failureIO)
+	}
+	metrics <- Metric{"probe_redis_query_duration_seconds", time.Since(queryStart).Seconds(), nil}
+
+	info, err := redis.String(conn.Do("INFO", "server"))
+	if err != nil {
+		module.logger.Warn("Error querying server version", "err", err)
+		return false, redisFailureReason(err, failureQuery, failureIO)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		if version := strings.TrimPrefix(scanner.Text(), "redis_version:"); version != scanner.Text() {
+			metrics <- Metric{"probe_redis_info", 1, map[string]string{"version": strings.TrimSpace(version)}}
+			break
+		}
+	}
+	return true, ""
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFakeRedis serves RESP commands on ln, accepting the password secret.
+func serveFakeRedis(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				// Commands are sent as arrays of bulk strings.
+				var n int
+				if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+					return
+				}
+				args := make([]string, n)
+				for i := range args {
+					var size int
+					fmt.Fscanf(r, "$%d\r\n", &size)
+					buf := make([]byte, size+2)
+					r.Read(buf)
+					args[i] = string(buf[:size])
+				}
+				switch strings.ToUpper(args[0]) {
+				case "AUTH":
+					if args[len(args)-1] == "secret" {
+						conn.Write([]byte("+OK\r\n"))
+					} else {
+						conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+					}
+				case "PING":
+					conn.Write([]byte("+PONG\r\n"))
+				case "INFO":
+					info := "# Server\r\nredis_version:7.2.4\r\nredis_mode:standalone\r\n"
+					fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(info), info)
+				default:
+					fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+				}
+			}
+		}()
+	}
+}
+
+func TestRedisPing(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	go serveFakeRedis(ln)
+
+	passwordFile, err := ioutil.TempFile("", "redis_password")
+	if err != nil {
+		t.Fatalf("Error creating password file: %s", err)
+	}
+	defer os.Remove(passwordFile.Name())
+	passwordFile.WriteString("secret\n")
+	passwordFile.Close()
+
+	for _, test := range []struct {
+		config  DatabaseProbe
+		success bool
+	}{
+		{DatabaseProbe{}, true},
+		{DatabaseProbe{PasswordFile: passwordFile.Name()}, true},
+		{DatabaseProbe{PasswordFile: passwordFile.Name() + ".missing"}, false},
+		{DatabaseProbe{Query: "FLUSHALL"}, false},
+	} {
+		module := Module{Timeout: time.Second, Redis: test.config}
+		metrics := make(chan Metric, 100)
+		if success, _ := probeRedis(ln.Addr().String(), module, metrics); success != test.success {
+			t.Fatalf("Unexpected result for %+v, want success %t", test.config, test.success)
+		}
+		close(metrics)
+		if !test.success {
+			continue
+		}
+		var version string
+		for m := range metrics {
+			if m.Name == "probe_redis_info" {
+				version = m.Labels["version"]
+			}
+		}
+		if version != "7.2.4" {
+			t.Fatalf("Unexpected version: got %q, want %q", version, "7.2.4")
+		}
+	}
+}
+
+func TestRedisEmptyQuery(t *testing.T) {
+	module := Module{Timeout: time.Second, Redis: DatabaseProbe{Query: " "}}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	success, failure := probeRedis("localhost:6379", module, metrics)
+	if success {
+		t.Fatalf("Redis module succeeded, expected failure.")
+	}
+	if failure != failureConfig {
+		t.Fatalf("Unexpected failure reason: got %q, want %q", failure, failureConfig)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultSMTPCodes are the reply codes expected for each command of the
+// session, unless overridden in expect_codes.
+var defaultSMTPCodes = map[string]int{
+	"banner":   220,
+	"ehlo":     250,
+	"starttls": 220,
+	"auth":     235,
+	"mail":     250,
+	"rcpt":     250,
+}
+
+// smtpSession is an SMTP session with a server, which reports the latency of
+// each command it runs.
+type smtpSession struct {
+	conn    net.Conn
+	text    *textproto.Conn
+	codes   map[string]int
+	metrics chan<- Metric
+}
+
+// command sends a command, unless line is empty, and reads the reply to it.
+// The reply code must match the code expected for the command, where a code
+// of 2 matches any 2xx code.
+func (s *smtpSession) command(name, line string) (string, error) {
+	start := time.Now()
+	if line != "" {
+		if err := s.text.PrintfLine("%s", line); err != nil {
+			return "", err
+		}
+	}
+	code, message, err := s.text.ReadResponse(s.codes[name])
+	s.metrics <- Metric{"probe_smtp_command_duration_seconds", time.Since(start).Seconds(), map[string]string{"command": name}}
+	if code != 0 {
+		s.metrics <- Metric{"probe_smtp_reply_code", float64(code), map[string]string{"command": name}}
+	}
+	return message, err
+}
+
+// ehlo greets the server and returns the extensions it advertises.
+func (s *smtpSession) ehlo(hostname string) (map[string]bool, error) {
+	message, err := s.command("ehlo", "EHLO "+hostname)
+	if err != nil {
+		return nil, err
+	}
+	// The first line is the greeting, the following ones list extensions and
+	// their parameters.
+	extensions := map[string]bool{}
+	lines := strings.Split(message, "\n")
+	for _, line := range lines[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			extensions[strings.ToUpper(fields[0])] = true
+		}
+	}
+	return extensions, nil
+}
+
+// smtpFailureReason classifies an error running a command, returning reason
+// if the server replied with an unexpected code.
+func smtpFailureReason(err error, reason failureReason) failureReason {
+	if _, ok := err.(*textproto.Error); ok {
+		return reason
+	}
+	return errorFailureReason(err, failureIO)
+}
+
+func probeSMTP(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	deadline := time.Now().Add(module.Timeout)
+	config := module.SMTP
+	if config.Hostname == "" {
+		config.Hostname = "localhost"
+	}
+	codes := map[string]int{}
+	for name, code := range defaultSMTPCodes {
+		codes[name] = code
+	}
+	for name, code := range config.ExpectCodes {
+		if _, ok := codes[name]; !ok {
+			module.logger.Error("Unknown SMTP command in expect_codes", "command", name)
+			return false, failureConfig
+		}
+		codes[name] = code
+	}
+	// AUTH PLAIN sends the credentials in cleartext.
+	if config.Username != "" && !config.StartTLS && !config.InsecureAuth {
+		module.logger.Error("Refusing to authenticate without STARTTLS, set insecure_auth to allow it")
+		return false, failureConfig
+	}
+	password, err := readPassword(config.PasswordFile)
+	if err != nil {
+		module.logger.Error("Error reading password file", "err", err)
+		return false, failureConfig
+	}
+
+	dialer, err := newModuleDialer(module, "tcp")
+	if err != nil {
+		module.logger.Error("Error in SMTP module", "err", err)
+		return false, failureConfig
+	}
+	dialStart := time.Now()
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		module.logger.Warn("Error dialing", "err", err)
+		return false, errorFailureReason(err, failureConnect)
+	}
+	defer conn.Close()
+	metrics <- Metric{"probe_smtp_connect_duration_seconds", time.Since(dialStart).Seconds(), nil}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return false, failureIO
+	}
+	s := &smtpSession{conn: conn, text: textproto.NewConn(conn), codes: codes, metrics: metrics}
+
+	if _, err := s.command("banner", ""); err != nil {
+		module.logger.Warn("Unexpected banner", "err", err)
+		return false, smtpFailureReason(err, failureProtocol)
+	}
+	extensions, err := s.ehlo(config.Hostname)
+	if err != nil {
+		module.logger.Warn("EHLO failed", "err", err)
+		return false, smtpFailureReason(err, failureProtocol)
+	}
+	if config.StartTLS {
+		if !extensions["STARTTLS"] {
+			module.logger.Warn("Target does not advertise STARTTLS")
+			return false, failureProtocol
+		}
+		if _, err := s.command("starttls", "STARTTLS"); err != nil {
+			module.logger.Warn("STARTTLS failed", "err", err)
+			return false, smtpFailureReason(err, failureProtocol)
+		}
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			module.logger.Error("Error splitting target", "err", err)
+			return false, failureConfig
+		}
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			module.logger.Warn("TLS handshake failed", "err", err)
+			return false, errorFailureReason(err, failureTLS)
+		}
+		state := tlsConn.ConnectionState()
+		metrics <- Metric{"probe_ssl_earliest_cert_expiry", float64(getEarliestCertExpiry(&state).UnixNano()) / 1e9, nil}
+		s.conn, s.text = tlsConn, textproto.NewConn(tlsConn)
+		// Extensions advertised before STARTTLS must be discarded.
+		if extensions, err = s.ehlo(config.Hostname); err != nil {
+			module.logger.Warn("EHLO after STARTTLS failed", "err", err)
+			return false, smtpFailureReason(err, failureProtocol)
+		}
+	}
+	names := make([]string, 0, len(extensions))
+	for extension := range extensions {
+		names = append(names, extension)
+	}
+	sort.Strings(names)
+	for _, extension := range names {
+		metrics <- Metric{"probe_smtp_extension_info", 1, map[string]string{"extension": extension}}
+	}
+
+	if config.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + config.Username + "\x00" + password))
+		if _, err := s.command("auth", "AUTH PLAIN "+credentials); err != nil {
+			module.logger.Warn("AUTH failed", "err", err)
+			return false, smtpFailureReason(err, failureAuth)
+		}
+	}
+	if config.MailFrom != "" {
+		if _, err := s.command("mail", "MAIL FROM:<"+config.MailFrom+">"); err != nil {
+			module.logger.Warn("MAIL FROM failed", "err", err)
+			return false, smtpFailureReason(err, failureProtocol)
+		}
+		if config.RcptTo != "" {
+			if _, err := s.command("rcpt", "RCPT TO:<"+config.RcptTo+">"); err != nil {
+				module.logger.Warn("RCPT TO failed", "err", err)
+				return false, smtpFailureReason(err, failureProtocol)
+			}
+		}
+	}
+	// The session is over either way, so don't fail the probe over QUIT.
+	s.text.PrintfLine("QUIT")
+	return true, ""
+}
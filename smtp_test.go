@@ -0,0 +1,179 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFakeSMTP serves a single SMTP session, which accepts the credentials
+// user/secret and mail to postmaster only.
+func serveFakeSMTP(t *testing.T, ln net.Listener, config *tls.Config) {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Errorf("Error accepting on socket: %s", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 mail.localhost ESMTP")
+	tlsActive := false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			command, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(command) {
+		case "EHLO":
+			if tlsActive {
+				text.PrintfLine("250-mail.localhost\r\n250-AUTH PLAIN\r\n250 8BITMIME")
+			} else {
+				text.PrintfLine("250-mail.localhost\r\n250-STARTTLS\r\n250 8BITMIME")
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, config)
+			text = textproto.NewConn(tlsConn)
+			tlsActive = true
+		case "AUTH":
+			credentials, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			if string(credentials) == "\x00user\x00secret" {
+				text.PrintfLine("235 Authentication successful")
+			} else {
+				text.PrintfLine("535 Authentication failed")
+			}
+		case "MAIL":
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if arg == "TO:<postmaster@localhost>" {
+				text.PrintfLine("250 OK")
+			} else {
+				text.PrintfLine("550 No such user")
+			}
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func TestSMTPTransaction(t *testing.T) {
+	// Borrow the test certificate of an httptest TLS server.
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+
+	passwordFiles := map[string]string{}
+	for _, password := range []string{"secret", "wrong"} {
+		passwordFile, err := ioutil.TempFile("", "password")
+		if err != nil {
+			t.Fatalf("Error creating password file: %s", err)
+		}
+		defer os.Remove(passwordFile.Name())
+		passwordFile.WriteString(password + "\n")
+		passwordFile.Close()
+		passwordFiles[password] = passwordFile.Name()
+	}
+
+	for _, test := range []struct {
+		config  SMTPProbe
+		success bool
+	}{
+		{SMTPProbe{}, true},
+		{SMTPProbe{StartTLS: true, Username: "user", PasswordFile: passwordFiles["secret"], MailFrom: "prober@localhost", RcptTo: "postmaster@localhost"}, true},
+		{SMTPProbe{StartTLS: true, Username: "user", PasswordFile: passwordFiles["wrong"]}, false},
+		{SMTPProbe{Username: "user", PasswordFile: passwordFiles["secret"], InsecureAuth: true}, true},
+		{SMTPProbe{MailFrom: "prober@localhost", RcptTo: "nobody@localhost"}, false},
+		// Check that relaying is denied.
+		{SMTPProbe{MailFrom: "prober@localhost", RcptTo: "nobody@localhost", ExpectCodes: map[string]int{"rcpt": 5}}, true},
+	} {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Error listening on socket: %s", err)
+		}
+		ch := make(chan (struct{}))
+		go func() {
+			serveFakeSMTP(t, ln, ts.TLS)
+			ch <- struct{}{}
+		}()
+		test.config.InsecureSkipVerify = true
+		module := Module{Timeout: time.Second, SMTP: test.config}
+		metrics := make(chan Metric, 100)
+		if success, _ := probeSMTP(ln.Addr().String(), module, metrics); success != test.success {
+			t.Fatalf("Unexpected result for %+v, want success %t", test.config, test.success)
+		}
+		ln.Close()
+		<-ch
+		close(metrics)
+		extensions := map[string]bool{}
+		commands := map[string]bool{}
+		for m := range metrics {
+			switch m.Name {
+			case "probe_smtp_extension_info":
+				extensions[m.Labels["extension"]] = true
+			case "probe_smtp_command_duration_seconds":
+				commands[m.Labels["command"]] = true
+			}
+		}
+		if test.config.StartTLS && (extensions["STARTTLS"] || !extensions["AUTH"]) {
+			t.Fatalf("Unexpected extensions after STARTTLS: %v", extensions)
+		}
+		if test.config.RcptTo != "" && !commands["rcpt"] {
+			t.Fatalf("RCPT TO duration not reported for %+v", test.config)
+		}
+	}
+}
+
+func TestSMTPUnknownExpectCode(t *testing.T) {
+	module := Module{
+		Timeout: time.Second,
+		SMTP:    SMTPProbe{ExpectCodes: map[string]int{"data": 354}},
+	}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, _ := probeSMTP("localhost:25", module, metrics); success {
+		t.Fatalf("SMTP module suceeded, expected failure.")
+	}
+}
+
+func TestSMTPAuthWithoutTLS(t *testing.T) {
+	module := Module{
+		Timeout: time.Second,
+		SMTP:    SMTPProbe{Username: "user"},
+	}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	success, failure := probeSMTP("localhost:25", module, metrics)
+	if success {
+		t.Fatalf("SMTP module suceeded, expected failure.")
+	}
+	if failure != failureConfig {
+		t.Fatalf("Unexpected failure reason: got %q, want %q", failure, failureConfig)
+	}
+}
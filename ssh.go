@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errSSHHostKeyReceived aborts the handshake once the server proved it holds
+// its host key, as the probe doesn't authenticate.
+var errSSHHostKeyReceived = errors.New("host key received")
+
+// sshVersionConn records the lines the server sends before the first binary
+// packet, which include its identification string.
+type sshVersionConn struct {
+	net.Conn
+	received []byte
+}
+
+func (c *sshVersionConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	// The identification string is limited to 255 bytes, but may be preceded
+	// by other lines.
+	if len(c.received) < 8192 {
+		c.received = append(c.received, b[:n]...)
+	}
+	return n, err
+}
+
+// serverVersion returns the server's identification string, if received.
+func (c *sshVersionConn) serverVersion() string {
+	for _, line := range bytes.Split(c.received, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			return strings.TrimRight(string(line), "\r")
+		}
+	}
+	return ""
+}
+
+// sshFingerprintMatches reports whether key matches one of the fingerprints,
+// given in either the SHA256 or the legacy MD5 format.
+func sshFingerprintMatches(key ssh.PublicKey, fingerprints []string) bool {
+	for _, fingerprint := range fingerprints {
+		if fingerprint == ssh.FingerprintSHA256(key) || strings.EqualFold(fingerprint, ssh.FingerprintLegacyMD5(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+func probeSSH(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	deadline := time.Now().Add(module.Timeout)
+	config := module.SSH
+
+	dialer, err := newModuleDialer(module, "tcp")
+	if err != nil {
+		module.logger.Error("Error in SSH module", "err", err)
+		return false, failureConfig
+	}
+	dialStart := time.Now()
+	tcpConn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		module.logger.Warn("Error dialing", "err", err)
+		return false, errorFailureReason(err, failureConnect)
+	}
+	defer tcpConn.Close()
+	metrics <- Metric{"probe_ssh_connect_duration_seconds", time.Since(dialStart).Seconds(), nil}
+	if err := tcpConn.SetDeadline(deadline); err != nil {
+		return false, failureIO
+	}
+	conn := &sshVersionConn{Conn: tcpConn}
+
+	var hostKey ssh.PublicKey
+	clientConfig := &ssh.ClientConfig{
+		User:              "prometheus",
+		HostKeyAlgorithms: config.HostKeyAlgorithms,
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errSSHHostKeyReceived
+		},
+	}
+	handshakeStart := time.Now()
+	_, _, _, err = ssh.NewClientConn(conn, target, clientConfig)
+	version := conn.serverVersion()
+	if hostKey == nil {
+		module.logger.Warn("SSH handshake failed", "version", version, "err", err)
+		return false, errorFailureReason(err, failureProtocol)
+	}
+	metrics <- Metric{"probe_ssh_handshake_duration_seconds", time.Since(handshakeStart).Seconds(), nil}
+
+	fingerprint := ssh.FingerprintSHA256(hostKey)
+	metrics <- Metric{"probe_ssh_info", 1, map[string]string{
+		"version":     version,
+		"key_type":    hostKey.Type(),
+		"fingerprint": fingerprint,
+	}}
+	if len(config.HostKeyFingerprints) > 0 {
+		if !sshFingerprintMatches(hostKey, config.HostKeyFingerprints) {
+			module.logger.Warn("Unexpected host key", "type", hostKey.Type(), "fingerprint", fingerprint)
+			metrics <- Metric{"probe_ssh_host_key_match", 0, nil}
+			return false, failureHostKey
+		}
+		metrics <- Metric{"probe_ssh_host_key_match", 1, nil}
+	}
+	return true, ""
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHHostKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating host key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Error creating signer: %s", err)
+	}
+	serverConfig := &ssh.ServerConfig{ServerVersion: "SSH-2.0-TestServer_1.0", NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+	fingerprint := ssh.FingerprintSHA256(signer.PublicKey())
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("Welcome, this line precedes the version\r\n"))
+			// The handshake fails once the prober hangs up.
+			go ssh.NewServerConn(conn, serverConfig)
+		}
+	}()
+
+	for _, test := range []struct {
+		fingerprints []string
+		success      bool
+	}{
+		{nil, true},
+		{[]string{"SHA256:invalid", fingerprint}, true},
+		{[]string{ssh.FingerprintLegacyMD5(signer.PublicKey())}, true},
+		{[]string{"SHA256:invalid"}, false},
+	} {
+		module := Module{
+			Timeout: time.Second,
+			SSH:     SSHProbe{HostKeyFingerprints: test.fingerprints},
+		}
+		metrics := make(chan Metric, 100)
+		if success, _ := probeSSH(ln.Addr().String(), module, metrics); success != test.success {
+			t.Fatalf("Unexpected result for fingerprints %v, want success %t", test.fingerprints, test.success)
+		}
+		close(metrics)
+		var info map[string]string
+		for m := range metrics {
+			if m.Name == "probe_ssh_info" {
+				info = m.Labels
+			}
+		}
+		if info["version"] != "SSH-2.0-TestServer_1.0" || info["key_type"] != "ssh-ed25519" || info["fingerprint"] != fingerprint {
+			t.Fatalf("Unexpected info labels: %v", info)
+		}
+	}
+}
+
+func TestSSHNotSSH(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("220 mail.localhost ESMTP\r\n"))
+		conn.Close()
+	}()
+	module := Module{Timeout: time.Second}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, _ := probeSSH(ln.Addr().String(), module, metrics); success {
+		t.Fatalf("SSH module succeeded, expected failure.")
+	}
+}
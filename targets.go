@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetHost extracts the host from a target, which depending on the prober
+// is a URL, a host and port or just a host.
+func targetHost(target string) string {
+	if strings.Contains(target, "://") {
+		if u, err := url.Parse(target); err == nil {
+			return u.Hostname()
+		}
+	}
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return strings.Trim(target, "[]")
+}
+
+// resolveTarget returns the addresses host resolves to, limited to those the
+// module's prober can probe.
+func resolveTarget(host string, module Module) ([]string, error) {
+	var protocol string
+	switch module.Prober {
+	case "icmp":
+		protocol = module.ICMP.Protocol
+	case "traceroute":
+		protocol = module.Traceroute.Protocol
+	}
+	if protocol == "" && (module.Prober == "icmp" || module.Prober == "traceroute") {
+		protocol = "ip4"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, ip := range ips {
+		if (protocol == "ip4" && ip.IP.To4() == nil) || (protocol == "ip6" && ip.IP.To4() != nil) {
+			continue
+		}
+		addresses = append(addresses, ip.IP.String())
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("no addresses found")
+	}
+	return addresses, nil
+}
+
+// probeLabelled runs a probe, adding labels to the metrics it reports along
+// with its duration, success and reason for failure. Labels the prober reports
+// itself which clash with these are renamed with an exported_ prefix.
+func probeLabelled(prober func(string, Module, chan<- Metric) (bool, failureReason), target string, module Module, labels map[string]string, metrics chan<- Metric) (bool, failureReason) {
+	probeMetrics := make(chan Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for metric := range probeMetrics {
+			merged := map[string]string{}
+			for name, value := range metric.Labels {
+				if _, ok := labels[name]; ok {
+					name = "exported_" + name
+				}
+				merged[name] = value
+			}
+			for name, value := range labels {
+				merged[name] = value
+			}
+			metrics <- Metric{metric.Name, metric.FloatValue, merged}
+		}
+	}()
+
+	start := time.Now()
+	success, reason := prober(target, module, probeMetrics)
+	probeMetrics <- Metric{"probe_duration_seconds", time.Since(start).Seconds(), nil}
+	if success {
+		probeMetrics <- Metric{"probe_success", 1, nil}
+	} else {
+		probeMetrics <- Metric{"probe_success", 0, nil}
+		probeMetrics <- Metric{"probe_failure_info", 1, map[string]string{"reason": string(reason)}}
+	}
+	close(probeMetrics)
+	<-done
+	return success, reason
+}
+
+// probeTargets probes several targets, or every address they resolve to,
+// concurrently, labelling their metrics with the target and address. It
+// reports success only if all probes succeeded, and otherwise the reason the
+// first of them in order failed for.
+func probeTargets(prober func(string, Module, chan<- Metric) (bool, failureReason), targets []string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	type probe struct {
+		target, host, address string
+	}
+	success := true
+	var reason failureReason
+	var probes []probe
+	for _, target := range targets {
+		if !module.ProbeAllAddresses {
+			probes = append(probes, probe{target: target})
+			continue
+		}
+		host := targetHost(target)
+		addresses, err := resolveTarget(host, module)
+		if err != nil {
+			module.logger.Warn("Error resolving target", "target", target, "err", err)
+			resolveReason := errorFailureReason(err, failureDNS)
+			metrics <- Metric{"probe_success", 0, map[string]string{"target": target}}
+			metrics <- Metric{"probe_failure_info", 1, map[string]string{"target": target, "reason": string(resolveReason)}}
+			if success {
+				success, reason = false, resolveReason
+			}
+			continue
+		}
+		for _, address := range addresses {
+			probes = append(probes, probe{target, host, address})
+		}
+	}
+
+	type result struct {
+		success bool
+		reason  failureReason
+	}
+	results := make([]result, len(probes))
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func(i int, p probe) {
+			defer wg.Done()
+			labels := map[string]string{"target": p.target}
+			if p.address != "" {
+				labels["address"] = p.address
+			}
+			m := module
+			m.host, m.address = p.host, p.address
+			m.logger = module.logger.with("target", p.target)
+			if p.address != "" {
+				m.logger = m.logger.with("address", p.address)
+			}
+			success, reason := probeLabelled(prober, p.target, m, labels, metrics)
+			results[i] = result{success, reason}
+		}(i, p)
+	}
+	wg.Wait()
+	for _, result := range results {
+		if success && !result.success {
+			reason = result.reason
+		}
+		success = success && result.success
+	}
+	return success, reason
+}
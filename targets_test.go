@@ -0,0 +1,88 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTargetHost(t *testing.T) {
+	for target, host := range map[string]string{
+		"https://example.com:8443/path": "example.com",
+		"example.com:443":               "example.com",
+		"[2001:db8::1]:80":              "2001:db8::1",
+		"example.com":                   "example.com",
+		"2001:db8::1":                   "2001:db8::1",
+	} {
+		if got := targetHost(target); got != host {
+			t.Fatalf("Unexpected host for %s: got %q, want %q", target, got, host)
+		}
+	}
+}
+
+func TestProbeMultipleTargets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	closed := closedPort(t, "tcp")
+
+	config := &Config{Modules: map[string]Module{
+		"tcp":     {Prober: "tcp", Timeout: time.Second},
+		"tcp_all": {Prober: "tcp", Timeout: time.Second, ProbeAllAddresses: true},
+	}}
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{
+			"module=tcp&target=" + ln.Addr().String() + "&target=" + closed,
+			[]string{
+				"probe_success{target=\"" + ln.Addr().String() + "\"} 1.000000",
+				"probe_success{target=\"" + closed + "\"} 0.000000",
+				"probe_success 0.000000",
+			},
+		},
+		{
+			"module=tcp_all&target=" + ln.Addr().String(),
+			[]string{
+				"probe_success{address=\"127.0.0.1\",target=\"" + ln.Addr().String() + "\"} 1.000000",
+				"probe_tcp_connect_duration_seconds{address=\"127.0.0.1\",target=\"" + ln.Addr().String() + "\"}",
+				"probe_success 1.000000",
+			},
+		},
+	} {
+		w := httptest.NewRecorder()
+		probeHandler(w, httptest.NewRequest("GET", "/probe?"+test.query, nil), config, newProbeHistory(10))
+		for _, line := range test.expected {
+			if !strings.Contains(w.Body.String(), line) {
+				t.Fatalf("Expected %q in the output for %s, got:\n%s", line, test.query, w.Body.String())
+			}
+		}
+	}
+}
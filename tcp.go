@@ -2,61 +2,216 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/prometheus/log"
 )
 
-func probeTCP(target string, module Module, metrics chan<- Metric) bool {
+// decodeHex decodes a hex string, ignoring any whitespace in it.
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// expectation matches responses against an expect regexp and the bytes of
+// an expect_hex option.
+type expectation struct {
+	re       *regexp.Regexp
+	contains []byte
+}
+
+func compileExpectation(expect, expectHex string) (*expectation, error) {
+	e := &expectation{}
+	var err error
+	if expect != "" {
+		if e.re, err = regexp.Compile(expect); err != nil {
+			return nil, fmt.Errorf("could not compile %q into regular expression: %v", expect, err)
+		}
+	}
+	if expectHex != "" {
+		if e.contains, err = decodeHex(expectHex); err != nil {
+			return nil, fmt.Errorf("could not decode %q as hex: %v", expectHex, err)
+		}
+	}
+	return e, nil
+}
+
+// match reports whether a response matches, along with the submatch indexes
+// of the regexp, if any.
+func (e *expectation) match(logger *probeLogger, response []byte) ([]int, bool) {
+	var match []int
+	if e.re != nil {
+		if match = e.re.FindSubmatchIndex(response); match == nil {
+			return nil, false
+		}
+		logger.Debug("Regexp matched", "regexp", e.re, "response", response)
+	}
+	if e.contains != nil && !bytes.Contains(response, e.contains) {
+		return nil, false
+	}
+	return match, true
+}
+
+// readFrame reads the next frame from r, which is the next n bytes if n is
+// positive, or else everything up to the delimiter.  The delimiter defaults to
+// a newline, in which case a preceding carriage return is stripped too.
+func readFrame(r *bufio.Reader, n int, delimiter string) ([]byte, error) {
+	if n > 0 {
+		frame := make([]byte, n)
+		_, err := io.ReadFull(r, frame)
+		return frame, err
+	}
+	if delimiter == "" {
+		delimiter = "\n"
+	}
+	var frame []byte
+	for {
+		chunk, err := r.ReadBytes(delimiter[len(delimiter)-1])
+		frame = append(frame, chunk...)
+		if err != nil {
+			// Like bufio.Scanner, return a final unterminated frame.
+			if err == io.EOF && len(frame) > 0 {
+				return frame, nil
+			}
+			return nil, err
+		}
+		if bytes.HasSuffix(frame, []byte(delimiter)) {
+			frame = frame[:len(frame)-len(delimiter)]
+			if delimiter == "\n" {
+				frame = bytes.TrimSuffix(frame, []byte("\r"))
+			}
+			return frame, nil
+		}
+		if len(frame) > bufio.MaxScanTokenSize {
+			return nil, bufio.ErrTooLong
+		}
+	}
+}
+
+func tcpStepDuration(step int, duration time.Duration) Metric {
+	return Metric{"probe_tcp_step_duration_seconds", duration.Seconds(), map[string]string{"step": strconv.Itoa(step)}}
+}
+
+func probeTCP(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
 	deadline := time.Now().Add(module.Timeout)
-	conn, err := net.DialTimeout("tcp", target, module.Timeout)
+	step, lastStep := -1, -1
+	var stepStart time.Time
+	captures := map[string]string{}
+	defer func() {
+		reportCaptures(module.logger, "probe_tcp", captures, module.TCP.CaptureValues, metrics)
+		// Report the duration of the step the probe failed in, if any.
+		if step > lastStep {
+			metrics <- tcpStepDuration(step, time.Since(stepStart))
+		}
+		metrics <- Metric{"probe_tcp_last_successful_step", float64(lastStep), nil}
+	}()
+
+	dialer, err := newModuleDialer(module, "tcp")
 	if err != nil {
-		return false
+		module.logger.Error("Error in TCP module", "err", err)
+		return false, failureConfig
+	}
+	dialStart := time.Now()
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		module.logger.Debug("Error dialing", "err", err)
+		return false, errorFailureReason(err, failureConnect)
 	}
 	defer conn.Close()
+	metrics <- Metric{"probe_tcp_connect_duration_seconds", time.Since(dialStart).Seconds(), nil}
 	// Set a deadline to prevent the following code from blocking forever.
 	// If a deadline cannot be set, better fail the probe by returning an error
 	// now rather than blocking forever.
 	if err := conn.SetDeadline(deadline); err != nil {
-		return false
+		return false, failureConnect
 	}
-	scanner := bufio.NewScanner(conn)
-	for _, qr := range module.TCP.QueryResponse {
-		log.Debugf("Processing query response entry %+v", qr)
+	reader := bufio.NewReader(conn)
+	for i, qr := range module.TCP.QueryResponse {
+		step, stepStart = i, time.Now()
+		module.logger.Debug("Processing query response entry", "entry", i)
 		send := qr.Send
-		if qr.Expect != "" {
-			re, err := regexp.Compile(qr.Expect)
+		if qr.Expect != "" || qr.ExpectHex != "" {
+			expect, err := compileExpectation(qr.Expect, qr.ExpectHex)
 			if err != nil {
-				log.Errorf("Could not compile %q into regular expression: %v", qr.Expect, err)
-				return false
+				module.logger.Error("Error in query response entry", "entry", i, "err", err)
+				return false, failureConfig
 			}
+			var frame []byte
 			var match []int
-			// Read lines until one of them matches the configured regexp.
-			for scanner.Scan() {
-				log.Debugf("read %q\n", scanner.Text())
-				match = re.FindSubmatchIndex(scanner.Bytes())
-				if match != nil {
-					log.Debugf("regexp %q matched %q", re, scanner.Text())
+			// Read frames until one of them matches the configured regexp
+			// and contains the configured bytes.
+			for {
+				frame, err = readFrame(reader, qr.ReadBytes, qr.Delimiter)
+				if err == io.EOF {
+					// The connection was closed without a match.
+					return false, failureRegexp
+				}
+				if err != nil {
+					module.logger.Debug("Error reading", "err", err)
+					return false, errorFailureReason(err, failureIO)
+				}
+				module.logger.Debug("Read", "data", string(frame))
+				var ok bool
+				if match, ok = expect.match(module.logger, frame); ok {
 					break
 				}
 			}
-			if scanner.Err() != nil {
-				return false
-			}
-			if match == nil {
-				return false
+			if expect.re != nil {
+				captureNamedGroups(expect.re, frame, match, captures)
+				send = string(expect.re.Expand(nil, []byte(send), frame, match))
 			}
-			send = string(re.Expand(nil, []byte(send), scanner.Bytes(), match))
 		}
 		if send != "" {
-			log.Debugf("Sending %q", send)
-			if _, err := fmt.Fprintf(conn, "%s\n", send); err != nil {
-				return false
+			module.logger.Debug("Sending", "data", send)
+			if !qr.NoTrailingNewline {
+				send += "\n"
+			}
+			if _, err := io.WriteString(conn, send); err != nil {
+				module.logger.Debug("Error writing", "err", err)
+				return false, errorFailureReason(err, failureIO)
+			}
+		}
+		if qr.SendHex != "" {
+			payload, err := decodeHex(qr.SendHex)
+			if err != nil {
+				module.logger.Error("Could not decode hex", "send_hex", qr.SendHex, "err", err)
+				return false, failureConfig
+			}
+			module.logger.Debug("Sending", "data", string(payload))
+			if _, err := conn.Write(payload); err != nil {
+				module.logger.Debug("Error writing", "err", err)
+				return false, errorFailureReason(err, failureIO)
+			}
+		}
+		if qr.StartTLS {
+			// Upgrade the connection to TLS, e.g. after the server confirmed
+			// a STARTTLS command.
+			host, _, err := net.SplitHostPort(target)
+			if err != nil {
+				module.logger.Error("Error splitting target", "err", err)
+				return false, failureConfig
+			}
+			tlsConn := tls.Client(conn, &tls.Config{
+				ServerName:         host,
+				InsecureSkipVerify: module.TCP.InsecureSkipVerify,
+			})
+			if err := tlsConn.Handshake(); err != nil {
+				module.logger.Warn("TLS handshake failed", "err", err)
+				return false, errorFailureReason(err, failureTLS)
 			}
+			state := tlsConn.ConnectionState()
+			metrics <- Metric{"probe_ssl_earliest_cert_expiry", float64(getEarliestCertExpiry(&state).UnixNano()) / 1e9, nil}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
 		}
+		metrics <- tcpStepDuration(i, time.Since(stepStart))
+		lastStep = i
 	}
-	return true
+	return true, ""
 }
@@ -14,8 +14,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -38,7 +41,7 @@ func TestTCPConnection(t *testing.T) {
 	}()
 	metrics := NewMetricSink()
 	defer close(metrics)
-	if !probeTCP(ln.Addr().String(), Module{Timeout: time.Second}, metrics) {
+	if success, _ := probeTCP(ln.Addr().String(), Module{Timeout: time.Second}, metrics); !success {
 		t.Fatalf("TCP module failed, expected success.")
 	}
 	<-ch
@@ -48,9 +51,13 @@ func TestTCPConnectionFails(t *testing.T) {
 	// Invalid port number.
 	metrics := NewMetricSink()
 	defer close(metrics)
-	if probeTCP(":0", Module{Timeout: time.Second}, metrics) {
+	success, reason := probeTCP(":0", Module{Timeout: time.Second}, metrics)
+	if success {
 		t.Fatalf("TCP module suceeded, expected failure.")
 	}
+	if reason != failureConnect {
+		t.Fatalf("Unexpected failure reason: got %q, want %q", reason, failureConnect)
+	}
 }
 
 func TestTCPConnectionQueryResponseIRC(t *testing.T) {
@@ -87,7 +94,7 @@ func TestTCPConnectionQueryResponseIRC(t *testing.T) {
 	}()
 	metrics := NewMetricSink()
 	defer close(metrics)
-	if !probeTCP(ln.Addr().String(), module, metrics) {
+	if success, _ := probeTCP(ln.Addr().String(), module, metrics); !success {
 		t.Fatalf("TCP module failed, expected success.")
 	}
 	<-ch
@@ -107,7 +114,7 @@ func TestTCPConnectionQueryResponseIRC(t *testing.T) {
 	}()
 	metrics = NewMetricSink()
 	defer close(metrics)
-	if probeTCP(ln.Addr().String(), module, metrics) {
+	if success, _ := probeTCP(ln.Addr().String(), module, metrics); success {
 		t.Fatalf("TCP module succeeded, expected failure.")
 	}
 	<-ch
@@ -147,10 +154,267 @@ func TestTCPConnectionQueryResponseMatching(t *testing.T) {
 	}()
 	metrics := NewMetricSink()
 	defer close(metrics)
-	if !probeTCP(ln.Addr().String(), module, metrics) {
+	if success, _ := probeTCP(ln.Addr().String(), module, metrics); !success {
 		t.Fatalf("TCP module failed, expected success.")
 	}
 	if got, want := <-ch, "OpenSSH_6.9p1"; got != want {
 		t.Fatalf("Read unexpected version: got %q, want %q", got, want)
 	}
 }
+
+func TestTCPConnectionQueryResponseStartTLS(t *testing.T) {
+	// Borrow the test certificate of an httptest TLS server.
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	module := Module{
+		Timeout: time.Second,
+		TCP: TCPProbe{
+			QueryResponse: []QueryResponse{
+				{Expect: "^220"},
+				{Send: "EHLO prober"},
+				{Expect: "^250-STARTTLS"},
+				{Send: "STARTTLS"},
+				{Expect: "^220", StartTLS: true},
+				{Send: "EHLO prober"},
+				{Expect: "^250-AUTH"},
+				{Send: "QUIT"},
+			},
+			InsecureSkipVerify: true,
+		},
+	}
+
+	ch := make(chan (struct{}))
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Error accepting on socket: %s", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		fmt.Fprintf(conn, "220 mail.localhost ESMTP\n")
+		var command, domain string
+		fmt.Fscanf(conn, "%s %s\n", &command, &domain)
+		fmt.Fprintf(conn, "250-mail.localhost\n250-STARTTLS\n250 8BITMIME\n")
+		fmt.Fscanf(conn, "%s\n", &command)
+		fmt.Fprintf(conn, "220 Ready to start TLS\n")
+		tlsConn := tls.Server(conn, ts.TLS)
+		fmt.Fscanf(tlsConn, "%s %s\n", &command, &domain)
+		fmt.Fprintf(tlsConn, "250-mail.localhost\n250-AUTH PLAIN\n250 8BITMIME\n")
+		fmt.Fscanf(tlsConn, "%s\n", &command)
+		fmt.Fprintf(tlsConn, "221 Bye\n")
+		ch <- struct{}{}
+	}()
+
+	metrics := make(chan Metric, 100)
+	if success, _ := probeTCP(ln.Addr().String(), module, metrics); !success {
+		t.Fatalf("TCP module failed, expected success.")
+	}
+	<-ch
+	close(metrics)
+	var expiry bool
+	for m := range metrics {
+		if m.Name == "probe_ssl_earliest_cert_expiry" && m.FloatValue > 0 {
+			expiry = true
+		}
+	}
+	if !expiry {
+		t.Fatalf("Certificate expiry metric not found.")
+	}
+}
+
+func TestTCPConnectionQueryResponseBinary(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	module := Module{
+		Timeout: time.Second,
+		TCP: TCPProbe{
+			QueryResponse: []QueryResponse{
+				// Redis PING in RESP.
+				{SendHex: "2a310d0a 24340d0a 50494e47 0d0a"},
+				{Expect: "^\\+PONG$", Delimiter: "\r\n"},
+				// An MQTT CONNECT, acknowledged by a fixed size CONNACK.
+				{Send: "\x10\x0c\x00\x04MQTT\x04\x02\x00\x3c\x00\x00", NoTrailingNewline: true},
+				{ExpectHex: "20020000", ReadBytes: 4},
+			},
+		},
+	}
+
+	ch := make(chan (struct{}))
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Error accepting on socket: %s", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		ping := make([]byte, 14)
+		if _, err := io.ReadFull(conn, ping); err != nil || string(ping) != "*1\r\n$4\r\nPING\r\n" {
+			t.Errorf("Unexpected PING: %q, %v", ping, err)
+		}
+		conn.Write([]byte("+PONG\r\n"))
+		connect := make([]byte, 14)
+		if _, err := io.ReadFull(conn, connect); err != nil || connect[0] != 0x10 || connect[13] != 0x00 {
+			t.Errorf("Unexpected CONNECT: %q, %v", connect, err)
+		}
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		ch <- struct{}{}
+	}()
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, _ := probeTCP(ln.Addr().String(), module, metrics); !success {
+		t.Fatalf("TCP module failed, expected success.")
+	}
+	<-ch
+}
+
+func TestTCPConnectionQueryResponseFailureStep(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	module := Module{
+		Timeout: time.Second,
+		TCP: TCPProbe{
+			QueryResponse: []QueryResponse{
+				{Expect: "^220"},
+				{Send: "HELO prober"},
+				{Expect: "^250"},
+			},
+		},
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Error accepting on socket: %s", err)
+			return
+		}
+		fmt.Fprintf(conn, "220 mail.localhost ESMTP\n")
+		fmt.Fprintf(conn, "554 Go away\n")
+		conn.Close()
+	}()
+	metrics := make(chan Metric, 100)
+	success, failure := probeTCP(ln.Addr().String(), module, metrics)
+	if success {
+		t.Fatalf("TCP module succeeded, expected failure.")
+	}
+	if failure != failureRegexp {
+		t.Fatalf("Unexpected failure reason: got %q, want %q", failure, failureRegexp)
+	}
+	close(metrics)
+	var steps string
+	lastStep := -2.0
+	for m := range metrics {
+		switch m.Name {
+		case "probe_tcp_step_duration_seconds":
+			steps += m.Labels["step"]
+		case "probe_tcp_last_successful_step":
+			lastStep = m.FloatValue
+		}
+	}
+	if lastStep != 1 {
+		t.Fatalf("Unexpected last successful step: got %f, want 1", lastStep)
+	}
+	if steps != "012" {
+		t.Fatalf("Unexpected step durations: got steps %q, want %q", steps, "012")
+	}
+}
+
+func TestTCPConnectionQueryResponseCaptures(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	module := Module{
+		Timeout: time.Second,
+		TCP: TCPProbe{
+			QueryResponse: []QueryResponse{
+				{Expect: "^220 (?P<host>\\S+) ESMTP (?P<version>.+)$"},
+				{Send: "QUEUE"},
+				{Expect: "^250 (?P<queued>\\d+) queued"},
+			},
+			CaptureValues: []string{"queued"},
+		},
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Error accepting on socket: %s", err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "220 mail.localhost ESMTP Postfix 3.1\n")
+		var command string
+		fmt.Fscanf(conn, "%s\n", &command)
+		fmt.Fprintf(conn, "250 17 queued\n")
+	}()
+	metrics := make(chan Metric, 100)
+	if success, _ := probeTCP(ln.Addr().String(), module, metrics); !success {
+		t.Fatalf("TCP module failed, expected success.")
+	}
+	close(metrics)
+	var info map[string]string
+	var queued float64
+	for m := range metrics {
+		switch m.Name {
+		case "probe_tcp_capture_info":
+			info = m.Labels
+		case "probe_tcp_capture_value":
+			queued = m.FloatValue
+		}
+	}
+	if info["host"] != "mail.localhost" || info["version"] != "Postfix 3.1" || queued != 17 {
+		t.Fatalf("Unexpected captures: got %v and %f queued", info, queued)
+	}
+}
+
+func TestTCPSourceIPAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+
+	remoteAddr := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Error accepting on socket: %s", err)
+			return
+		}
+		remoteAddr <- conn.RemoteAddr().String()
+		conn.Close()
+	}()
+	metrics := NewMetricSink()
+	defer close(metrics)
+	module := Module{Timeout: time.Second, SourceIPAddress: "127.0.0.2"}
+	if success, _ := probeTCP(ln.Addr().String(), module, metrics); !success {
+		t.Fatalf("TCP module failed, expected success.")
+	}
+	if host, _, _ := net.SplitHostPort(<-remoteAddr); host != "127.0.0.2" {
+		t.Fatalf("Unexpected source address: got %s, want 127.0.0.2", host)
+	}
+
+	module.SourceIPAddress = "not-an-ip"
+	if success, _ := probeTCP(ln.Addr().String(), module, metrics); success {
+		t.Fatalf("TCP module succeeded with an invalid source address, expected failure.")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// tracerouteHop is the outcome of probing the path with a single TTL.
+type tracerouteHop struct {
+	// address is the router or target which replied, nil if none did.
+	address net.IP
+	rtt     time.Duration
+	// reached is set if the target itself replied.
+	reached bool
+	// unreachable is set if a router reported the target as unreachable.
+	unreachable bool
+}
+
+// traceroute holds the state of a single traceroute probe.  Replies are
+// received through the shared ICMP listener, while requests are sent over a
+// socket of the probe's own so that the TTL can be set per request.
+type traceroute struct {
+	config TracerouteProbe
+	socket *icmpSocket
+	ip     *net.IPAddr
+	ip6    bool
+	// source and device are the source IP address and device to bind
+	// requests to, if any.
+	source net.IP
+	device string
+
+	conn net.PacketConn
+	p4   *ipv4.PacketConn
+	p6   *ipv6.PacketConn
+}
+
+func (t *traceroute) setTTL(ttl int) error {
+	if t.ip6 {
+		return t.p6.SetHopLimit(ttl)
+	}
+	return t.p4.SetTTL(ttl)
+}
+
+// open creates the socket the ICMP and UDP methods send requests over.
+func (t *traceroute) open() error {
+	var err error
+	var lc net.ListenConfig
+	if t.device != "" {
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			return bindToDevice(c, t.device)
+		}
+	}
+	var source string
+	if t.source != nil {
+		source = t.source.String()
+	}
+	switch t.config.Method {
+	case "icmp":
+		network, address := icmpNetwork(ICMPProbe{Protocol: t.config.Protocol}, source)
+		t.conn, err = lc.ListenPacket(context.Background(), network, address)
+	case "udp":
+		network := "udp4"
+		if t.ip6 {
+			network = "udp6"
+		}
+		t.conn, err = lc.ListenPacket(context.Background(), network, net.JoinHostPort(source, "0"))
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if t.ip6 {
+		t.p6 = ipv6.NewPacketConn(t.conn)
+	} else {
+		t.p4 = ipv4.NewPacketConn(t.conn)
+	}
+	if t.config.Method == "icmp" {
+		// Replies are read from the shared socket, so don't let the kernel
+		// queue copies of every ICMP packet on this one.
+		if t.ip6 {
+			var f ipv6.ICMPFilter
+			f.SetAll(true)
+			t.p6.SetICMPFilter(&f)
+		} else {
+			var f ipv4.ICMPFilter
+			f.SetAll(true)
+			t.p4.SetICMPFilter(&f)
+		}
+	}
+	return nil
+}
+
+func (t *traceroute) close() {
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
+
+// hop probes the path with the given TTL, waiting for a reply until deadline.
+func (t *traceroute) hop(ttl int, deadline time.Time) (tracerouteHop, error) {
+	switch t.config.Method {
+	case "udp":
+		return t.hopUDP(ttl, deadline)
+	case "tcp":
+		return t.hopTCP(ttl, deadline)
+	}
+	return t.hopICMP(ttl, deadline)
+}
+
+// fromReply fills in the hop from an ICMP message received for its request.
+func (t *traceroute) fromReply(reply icmpReply, sent time.Time) tracerouteHop {
+	hop := tracerouteHop{address: reply.peer, rtt: reply.received.Sub(sent)}
+	switch reply.message.Body.(type) {
+	case *icmp.Echo:
+		hop.reached = true
+	case *icmp.TimeExceeded:
+	default:
+		// Destination unreachable from the target itself, e.g. port
+		// unreachable for UDP, still means it was reached.
+		if reply.peer.Equal(t.ip.IP) {
+			hop.reached = true
+		} else {
+			hop.unreachable = true
+		}
+	}
+	return hop
+}
+
+func (t *traceroute) hopICMP(ttl int, deadline time.Time) (tracerouteHop, error) {
+	key, replies, err := icmpListenerInstance.register(t.socket, t.ip.IP)
+	if err != nil {
+		return tracerouteHop{}, err
+	}
+	defer icmpListenerInstance.unregister(key)
+
+	var requestType icmp.Type = ipv4.ICMPTypeEcho
+	if t.ip6 {
+		requestType = ipv6.ICMPTypeEchoRequest
+	}
+	wm := icmp.Message{
+		Type: requestType, Code: 0,
+		Body: &icmp.Echo{
+			ID: key.id, Seq: key.seq,
+			Data: []byte("Prometheus Blackbox Exporter"),
+		},
+	}
+	wb, err := wm.Marshal(nil)
+	if err != nil {
+		return tracerouteHop{}, err
+	}
+	if err := t.setTTL(ttl); err != nil {
+		return tracerouteHop{}, err
+	}
+	sent := time.Now()
+	if _, err := t.conn.WriteTo(wb, t.ip); err != nil {
+		return tracerouteHop{}, err
+	}
+	return t.wait(replies, sent, deadline), nil
+}
+
+func (t *traceroute) hopUDP(ttl int, deadline time.Time) (tracerouteHop, error) {
+	// Use a different destination port per hop, as classic traceroute does.
+	dst := &net.UDPAddr{IP: t.ip.IP, Zone: t.ip.Zone, Port: t.config.Port + ttl - 1}
+	key := icmpKey{
+		network: t.socket.network,
+		proto:   protocolUDP,
+		id:      t.conn.LocalAddr().(*net.UDPAddr).Port,
+		seq:     dst.Port,
+		peer:    t.ip.IP.String(),
+	}
+	replies, err := icmpListenerInstance.registerKey(key)
+	if err != nil {
+		return tracerouteHop{}, err
+	}
+	defer icmpListenerInstance.unregister(key)
+
+	if err := t.setTTL(ttl); err != nil {
+		return tracerouteHop{}, err
+	}
+	sent := time.Now()
+	if _, err := t.conn.WriteTo([]byte("Prometheus Blackbox Exporter"), dst); err != nil {
+		return tracerouteHop{}, err
+	}
+	return t.wait(replies, sent, deadline), nil
+}
+
+func (t *traceroute) hopTCP(ttl int, deadline time.Time) (tracerouteHop, error) {
+	// The key is only known once the socket is bound, which happens in the
+	// dialing goroutine.
+	var key icmpKey
+	registered := make(chan (<-chan icmpReply), 1)
+	dialer := net.Dialer{
+		Deadline: deadline,
+		Control: func(_, _ string, c syscall.RawConn) error {
+			// Bind before connecting, so that ICMP errors quoting the SYN
+			// can be matched by the source port.
+			if t.device != "" {
+				if err := bindToDevice(c, t.device); err != nil {
+					return err
+				}
+			}
+			port, err := bindTracerouteSocket(c, t.ip6, ttl, t.source)
+			if err != nil {
+				return err
+			}
+			k := icmpKey{
+				network: t.socket.network,
+				proto:   protocolTCP,
+				id:      port,
+				seq:     t.config.Port,
+				peer:    t.ip.IP.String(),
+			}
+			replies, err := icmpListenerInstance.registerKey(k)
+			if err != nil {
+				return err
+			}
+			key = k
+			registered <- replies
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	network := "tcp4"
+	if t.ip6 {
+		network = "tcp6"
+	}
+	address := net.JoinHostPort(t.ip.String(), strconv.Itoa(t.config.Port))
+	dialed := make(chan error, 1)
+	sent := time.Now()
+	go func() {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+	pending := dialed
+	defer func() {
+		// Wait for the dial to be cancelled before releasing the key.
+		cancel()
+		if pending != nil {
+			<-dialed
+		}
+		if key.peer != "" {
+			icmpListenerInstance.unregister(key)
+		}
+	}()
+
+	var replies <-chan icmpReply
+	timeout := time.NewTimer(deadline.Sub(time.Now()))
+	defer timeout.Stop()
+	for {
+		select {
+		case replies = <-registered:
+		case err := <-pending:
+			pending = nil
+			// A SYN-ACK or RST means the SYN made it to the target.
+			if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+				return tracerouteHop{address: t.ip.IP, rtt: time.Since(sent), reached: true}, nil
+			}
+			if key.peer == "" {
+				return tracerouteHop{}, err
+			}
+			// Otherwise the SYN got no answer before the deadline, but an
+			// ICMP error for it may still be pending.
+		case reply := <-replies:
+			return t.fromReply(reply, sent), nil
+		case <-timeout.C:
+			return tracerouteHop{}, nil
+		}
+	}
+}
+
+// wait waits for a reply to a request sent at sent until deadline.
+func (t *traceroute) wait(replies <-chan icmpReply, sent, deadline time.Time) tracerouteHop {
+	timeout := time.NewTimer(deadline.Sub(time.Now()))
+	defer timeout.Stop()
+	select {
+	case reply := <-replies:
+		return t.fromReply(reply, sent)
+	case <-timeout.C:
+		return tracerouteHop{}
+	}
+}
+
+func probeTraceroute(target string, module Module, metrics chan<- Metric) (success bool, reason failureReason) {
+	deadline := time.Now().Add(module.Timeout)
+	config := module.Traceroute
+	if config.Method == "" {
+		config.Method = "icmp"
+	}
+	if config.Protocol == "" {
+		config.Protocol = "ip4"
+	}
+	if config.MaxHops == 0 {
+		config.MaxHops = 30
+	}
+	if config.HopTimeout == 0 {
+		config.HopTimeout = module.Timeout / time.Duration(config.MaxHops)
+	}
+	if config.Port == 0 {
+		switch config.Method {
+		case "udp":
+			config.Port = 33434
+		case "tcp":
+			config.Port = 80
+		}
+	}
+	if config.Method != "icmp" && config.Method != "udp" && config.Method != "tcp" {
+		module.logger.Error("Unknown traceroute method", "method", config.Method)
+		return false, failureConfig
+	}
+	if config.Protocol != "ip4" && config.Protocol != "ip6" {
+		module.logger.Error("Unknown traceroute protocol", "protocol", config.Protocol)
+		return false, failureConfig
+	}
+
+	// ICMP errors are only delivered to raw sockets, so traceroute always
+	// requires privileged access.
+	source, err := sourceIP(module)
+	if err != nil {
+		module.logger.Error("Error in traceroute module", "err", err)
+		return false, failureConfig
+	}
+	network, address := icmpNetwork(ICMPProbe{Protocol: config.Protocol}, module.SourceIPAddress)
+	socket, err := icmpListenerInstance.socket(network, address, module.BindToDevice, false)
+	if err != nil {
+		module.logger.Error("Error listening to socket", "err", err)
+		return false, failureConfig
+	}
+
+	ip, err := resolveIPAddr(module, config.Protocol, target)
+	if err != nil {
+		module.logger.Error("Error resolving address", "err", err)
+		return false, errorFailureReason(err, failureDNS)
+	}
+	module.logger.Debug("Resolved target", "ip", ip)
+
+	t := &traceroute{
+		config: config,
+		socket: socket,
+		ip:     ip,
+		ip6:    config.Protocol == "ip6",
+		source: source,
+		device: module.BindToDevice,
+	}
+	if err := t.open(); err != nil {
+		module.logger.Error("Error opening traceroute socket", "err", err)
+		return false, failureConfig
+	}
+	defer t.close()
+
+	hops := 0
+	for ttl := 1; ttl <= config.MaxHops && time.Now().Before(deadline); ttl++ {
+		hopDeadline := time.Now().Add(config.HopTimeout)
+		if hopDeadline.After(deadline) {
+			hopDeadline = deadline
+		}
+		hop, err := t.hop(ttl, hopDeadline)
+		if err != nil {
+			module.logger.Error("Error probing hop", "hop", ttl, "err", err)
+			return false, failureConnect
+		}
+		hops = ttl
+		if hop.address != nil {
+			metrics <- Metric{"probe_traceroute_hop_rtt_seconds", hop.rtt.Seconds(), map[string]string{
+				"hop":     strconv.Itoa(ttl),
+				"address": hop.address.String(),
+			}}
+		} else {
+			module.logger.Debug("No reply for hop", "hop", ttl)
+		}
+		if hop.reached {
+			success = true
+			break
+		}
+		if hop.unreachable {
+			module.logger.Info("Hop reported target as unreachable", "hop", ttl, "hop_address", hop.address)
+			break
+		}
+	}
+
+	metrics <- Metric{"probe_traceroute_hops", float64(hops), nil}
+	if success {
+		metrics <- Metric{"probe_traceroute_destination_reached", 1, nil}
+	} else {
+		metrics <- Metric{"probe_traceroute_destination_reached", 0, nil}
+		reason = failureUnreachable
+	}
+	return
+}
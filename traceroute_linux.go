@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindTracerouteSocket sets the TTL of packets sent over c and binds it to an
+// ephemeral port, and the source address if not nil, returning the port.
+func bindTracerouteSocket(c syscall.RawConn, ip6 bool, ttl int, source net.IP) (port int, err error) {
+	cerr := c.Control(func(fd uintptr) {
+		var sa syscall.Sockaddr
+		if ip6 {
+			sa6 := &syscall.SockaddrInet6{}
+			copy(sa6.Addr[:], source.To16())
+			sa = sa6
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+		} else {
+			sa4 := &syscall.SockaddrInet4{}
+			copy(sa4.Addr[:], source.To4())
+			sa = sa4
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		}
+		if err != nil {
+			return
+		}
+		if err = syscall.Bind(int(fd), sa); err != nil {
+			return
+		}
+		if sa, err = syscall.Getsockname(int(fd)); err != nil {
+			return
+		}
+		switch sa := sa.(type) {
+		case *syscall.SockaddrInet4:
+			port = sa.Port
+		case *syscall.SockaddrInet6:
+			port = sa.Port
+		}
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return port, err
+}
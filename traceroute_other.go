@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func bindTracerouteSocket(c syscall.RawConn, ip6 bool, ttl int, source net.IP) (int, error) {
+	return 0, errors.New("TCP traceroute is only supported on Linux")
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTracerouteLocalhost(t *testing.T) {
+	if _, err := icmpListenerInstance.socket("ip4:icmp", "0.0.0.0", "", false); err != nil {
+		t.Skipf("Cannot open ICMP socket: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	for _, method := range []string{"icmp", "udp", "tcp"} {
+		metrics := make(chan Metric, 100)
+		// Allow the first hop the whole timeout, rather than a share of it
+		// per hop, so that a slow reply on a loaded machine is not taken
+		// for a missing first hop.
+		module := Module{
+			Timeout:    time.Second,
+			Traceroute: TracerouteProbe{Method: method, Port: port, HopTimeout: time.Second},
+		}
+		if success, _ := probeTraceroute("127.0.0.1", module, metrics); !success {
+			t.Fatalf("Traceroute with method %s failed, expected success.", method)
+		}
+		close(metrics)
+		var hop Metric
+		for m := range metrics {
+			if m.Name == "probe_traceroute_hop_rtt_seconds" {
+				hop = m
+			}
+		}
+		if hop.Labels["hop"] != strconv.Itoa(1) || hop.Labels["address"] != "127.0.0.1" {
+			t.Fatalf("Unexpected hop for method %s: %v", method, hop)
+		}
+	}
+}
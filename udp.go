@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// UnmarshalYAML rejects a negative number of retries when the config is
+// loaded.
+func (p *UDPProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain UDPProbe
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+	if p.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", p.Retries)
+	}
+	return nil
+}
+
+func probeUDP(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	deadline := time.Now().Add(module.Timeout)
+	config := module.UDP
+
+	expect, err := compileExpectation(config.Expect, config.ExpectHex)
+	if err != nil {
+		module.logger.Error("Error in UDP module", "err", err)
+		return false, failureConfig
+	}
+	if config.Retries < 0 {
+		module.logger.Error("Negative number of retries", "retries", config.Retries)
+		return false, failureConfig
+	}
+	payload := []byte(config.Send)
+	if config.SendHex != "" {
+		data, err := decodeHex(config.SendHex)
+		if err != nil {
+			module.logger.Error("Could not decode hex", "send_hex", config.SendHex, "err", err)
+			return false, failureConfig
+		}
+		payload = append(payload, data...)
+	}
+	if len(payload) == 0 {
+		module.logger.Error("No payload configured for UDP probe")
+		return false, failureConfig
+	}
+
+	// A connected socket only receives datagrams from the target, and reports
+	// ICMP port unreachable errors as refused reads.
+	dialer, err := newModuleDialer(module, "udp")
+	if err != nil {
+		module.logger.Error("Error in UDP module", "err", err)
+		return false, failureConfig
+	}
+	conn, err := dialer.Dial("udp", target)
+	if err != nil {
+		module.logger.Warn("Error dialing", "err", err)
+		return false, errorFailureReason(err, failureConnect)
+	}
+	defer conn.Close()
+
+	// Split the timeout evenly between the request and its retries.
+	attempts := config.Retries + 1
+	attemptTimeout := module.Timeout / time.Duration(attempts)
+	buf := make([]byte, 65535)
+	// Fail on a timeout, unless replies came which did not match.
+	reason := failureTimeout
+	for attempt := 0; attempt < attempts; attempt++ {
+		sent := time.Now()
+		attemptDeadline := sent.Add(attemptTimeout)
+		if attemptDeadline.After(deadline) {
+			attemptDeadline = deadline
+		}
+		if err := conn.SetDeadline(attemptDeadline); err != nil {
+			return false, failureIO
+		}
+		module.logger.Debug("Sending", "data", string(payload))
+		if _, err := conn.Write(payload); err != nil {
+			module.logger.Warn("Error writing", "err", err)
+			return false, errorFailureReason(err, failureIO)
+		}
+		// Read datagrams until one of them matches, or the attempt times out.
+		for {
+			n, err := conn.Read(buf)
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				module.logger.Debug("No matching reply", "attempt", attempt)
+				break
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// The target replied with ICMP port unreachable.
+				module.logger.Warn("Port unreachable")
+				metrics <- Metric{"probe_udp_retries", float64(attempt), nil}
+				return false, failureConnect
+			}
+			if err != nil {
+				module.logger.Warn("Error reading", "err", err)
+				metrics <- Metric{"probe_udp_retries", float64(attempt), nil}
+				return false, errorFailureReason(err, failureIO)
+			}
+			module.logger.Debug("Read", "data", string(buf[:n]))
+			reason = failureRegexp
+			if match, ok := expect.match(module.logger, buf[:n]); ok {
+				metrics <- Metric{"probe_udp_rtt_seconds", time.Since(sent).Seconds(), nil}
+				metrics <- Metric{"probe_udp_retries", float64(attempt), nil}
+				if expect.re != nil {
+					captures := map[string]string{}
+					captureNamedGroups(expect.re, buf[:n], match, captures)
+					reportCaptures(module.logger, "probe_udp", captures, config.CaptureValues, metrics)
+				}
+				return true, ""
+			}
+		}
+	}
+	metrics <- Metric{"probe_udp_retries", float64(attempts - 1), nil}
+	return false, reason
+}
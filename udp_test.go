@@ -0,0 +1,126 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestUDPQueryResponse(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening on socket: %s", err)
+	}
+	defer conn.Close()
+
+	module := Module{
+		Timeout: time.Second,
+		UDP: UDPProbe{
+			Send:          "status",
+			SendHex:       "00ff",
+			Expect:        "^ok (?P<players>\\d+)$",
+			ExpectHex:     "6f6b",
+			Retries:       2,
+			CaptureValues: []string{"players"},
+		},
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for i := 0; ; i++ {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(buf[:n], []byte("status\x00\xff")) {
+				t.Errorf("Unexpected request: %q", buf[:n])
+				return
+			}
+			// Drop the first request to exercise retries, and send an
+			// unrelated datagram before the matching reply to the second.
+			if i == 0 {
+				continue
+			}
+			conn.WriteTo([]byte("busy"), addr)
+			conn.WriteTo([]byte("ok 3"), addr)
+		}
+	}()
+	metrics := make(chan Metric, 100)
+	if success, _ := probeUDP(conn.LocalAddr().String(), module, metrics); !success {
+		t.Fatalf("UDP module failed, expected success.")
+	}
+	close(metrics)
+	retries, players := -1.0, -1.0
+	for m := range metrics {
+		switch m.Name {
+		case "probe_udp_retries":
+			retries = m.FloatValue
+		case "probe_udp_capture_value":
+			players = m.FloatValue
+		}
+	}
+	if retries != 1 {
+		t.Fatalf("Unexpected retries: got %f, want 1", retries)
+	}
+	if players != 3 {
+		t.Fatalf("Unexpected captured players: got %f, want 3", players)
+	}
+}
+
+func TestUDPPortUnreachable(t *testing.T) {
+	target := closedPort(t, "udp")
+
+	module := Module{
+		Timeout: 2 * time.Second,
+		UDP:     UDPProbe{Send: "status", Retries: 1},
+	}
+	start := time.Now()
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, _ := probeUDP(target, module, metrics); success {
+		t.Fatalf("UDP module succeeded, expected failure.")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("UDP module took %s to fail, expected it to fail fast", time.Since(start))
+	}
+}
+
+func TestUDPNegativeRetries(t *testing.T) {
+	module := Module{
+		Timeout: time.Second,
+		UDP:     UDPProbe{Send: "status", Retries: -1},
+	}
+	metrics := NewMetricSink()
+	defer close(metrics)
+	if success, failure := probeUDP("localhost:9", module, metrics); success || failure != failureConfig {
+		t.Fatalf("UDP module with negative retries returned %v with reason %q, expected a config failure.", success, failure)
+	}
+
+	config := `
+modules:
+  udp:
+    prober: udp
+    udp:
+      send: status
+      retries: -1
+`
+	if err := yaml.Unmarshal([]byte(config), &Config{}); err == nil {
+		t.Fatalf("Loading a config with negative retries succeeded, expected an error.")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func probeWebSocket(target string, module Module, metrics chan<- Metric) (bool, failureReason) {
+	deadline := time.Now().Add(module.Timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	config := module.WebSocket
+
+	var expect *regexp.Regexp
+	if config.Expect != "" {
+		var err error
+		if expect, err = regexp.Compile(config.Expect); err != nil {
+			module.logger.Error("Could not compile regular expression", "expression", config.Expect, "err", err)
+			return false, failureConfig
+		}
+	}
+	if !strings.HasPrefix(target, "ws://") && !strings.HasPrefix(target, "wss://") {
+		target = "ws://" + target
+	}
+
+	netDialer, err := newModuleDialer(module, "tcp")
+	if err != nil {
+		module.logger.Error("Error in WebSocket module", "err", err)
+		return false, failureConfig
+	}
+	dialer := websocket.Dialer{
+		Proxy:           websocket.DefaultDialer.Proxy,
+		NetDialContext:  netDialer.DialContext,
+		TLSClientConfig: httpTLSConfig(module.HTTP),
+	}
+	// A proxy would be dialed at the pinned address instead of the target.
+	if module.address != "" {
+		dialer.Proxy = nil
+	}
+	handshakeStart := time.Now()
+	conn, resp, err := dialer.DialContext(ctx, target, httpHeaders(module.HTTP))
+	if resp != nil {
+		metrics <- Metric{"probe_http_status_code", float64(resp.StatusCode), nil}
+	}
+	if err != nil {
+		module.logger.Warn("Error upgrading connection", "err", err)
+		if err == websocket.ErrBadHandshake && resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return false, failureStatusCode
+		}
+		return false, httpErrorFailureReason(err)
+	}
+	defer conn.Close()
+	metrics <- Metric{"probe_websocket_handshake_duration_seconds", time.Since(handshakeStart).Seconds(), nil}
+	if tlsConn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		metrics <- Metric{"probe_ssl_earliest_cert_expiry", float64(getEarliestCertExpiry(&state).UnixNano()) / 1e9, nil}
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return false, failureIO
+	}
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return false, failureIO
+	}
+
+	sent := time.Now()
+	if config.Send != "" {
+		module.logger.Debug("Sending", "data", config.Send)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(config.Send)); err != nil {
+			module.logger.Warn("Error writing", "err", err)
+			return false, errorFailureReason(err, failureIO)
+		}
+	}
+	if expect != nil {
+		// Read messages until one of them matches.
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				module.logger.Warn("Error reading", "err", err)
+				return false, errorFailureReason(err, failureIO)
+			}
+			module.logger.Debug("Read", "data", string(message))
+			if expect.Match(message) {
+				break
+			}
+		}
+		metrics <- Metric{"probe_websocket_rtt_seconds", time.Since(sent).Seconds(), nil}
+	}
+
+	// Close the connection cleanly, without waiting for the server's reply.
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return true, ""
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketEcho(t *testing.T) {
+	var token string
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Token")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte("welcome"))
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, append([]byte("echo: "), message...))
+		}
+	}))
+	defer ts.Close()
+	target := "wss://" + strings.TrimPrefix(ts.URL, "https://")
+
+	for _, test := range []struct {
+		config  WebSocketProbe
+		success bool
+	}{
+		{WebSocketProbe{}, true},
+		{WebSocketProbe{Expect: "^welcome$"}, true},
+		{WebSocketProbe{Send: "ping", Expect: "^echo: ping$"}, true},
+		{WebSocketProbe{Send: "ping", Expect: "^pong$"}, false},
+	} {
+		module := Module{
+			Timeout: time.Second,
+			HTTP: HTTPProbe{
+				Headers:            map[string]secret{"X-Token": "secret"},
+				InsecureSkipVerify: true,
+			},
+			WebSocket: test.config,
+		}
+		metrics := make(chan Metric, 100)
+		if success, _ := probeWebSocket(target, module, metrics); success != test.success {
+			t.Fatalf("Unexpected result for %+v, want success %t", test.config, test.success)
+		}
+		close(metrics)
+		var rtt, expiry bool
+		for m := range metrics {
+			switch m.Name {
+			case "probe_websocket_rtt_seconds":
+				rtt = true
+			case "probe_ssl_earliest_cert_expiry":
+				expiry = m.FloatValue > 0
+			}
+		}
+		if test.success && rtt != (test.config.Expect != "") {
+			t.Fatalf("Unexpected round trip time metric for %+v", test.config)
+		}
+		if !expiry {
+			t.Fatalf("Certificate expiry metric not found.")
+		}
+		if token != "secret" {
+			t.Fatalf("Unexpected X-Token header: got %q", token)
+		}
+	}
+}
+
+func TestWebSocketUpgradeFails(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	metrics := make(chan Metric, 100)
+	if success, _ := probeWebSocket(strings.TrimPrefix(ts.URL, "http://"), Module{Timeout: time.Second}, metrics); success {
+		t.Fatalf("WebSocket module succeeded, expected failure.")
+	}
+	close(metrics)
+	var status float64
+	for m := range metrics {
+		if m.Name == "probe_http_status_code" {
+			status = m.FloatValue
+		}
+	}
+	if status != http.StatusNotFound {
+		t.Fatalf("Unexpected status code: got %f, want 404", status)
+	}
+}